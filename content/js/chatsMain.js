@@ -29,18 +29,24 @@ window.convertTsToTime = function convertTsToTime(ts) {
     return `${hoursString}:${minutesString}`;
 }
 
-window.connectToLiveUpdates = function connectToLiveUpdates(accessKey) {
+window.connectToLiveUpdates = function connectToLiveUpdates(getAccessKey) {
     return new Promise((resolve, reject) => {
         let ws = new WebSocket('ws://' + location.host + '/liveUpdates');
         let eventListeners = [];
         ws.onopen = resolve({
             subscribe: function(subscriptions) {
                 ws.send(JSON.stringify({
-                    accessKey: accessKey,
+                    accessKey: getAccessKey(),
                     event: 'subscribe',
                     eventData: subscriptions
                 }));
             },
+            ping: function() {
+                ws.send(JSON.stringify({
+                    accessKey: getAccessKey(),
+                    event: 'activity'
+                }));
+            },
             addEventListener: function(eventName, callback) {
                 eventListeners.push({eventName, callback});
             }
@@ -115,7 +121,7 @@ window.chatsPageScript = async function chatsPageScript() {
             } else {
                 messageIdsToDelete = [];
                 for (let message of selectedMessages) {
-                    if (message.dataset.senderId == activeUserId || activeChatOwnerId == activeUserId) {
+                    if (message.dataset.senderId == activeUserId || canDeleteOthersMessages(message.dataset.senderId)) {
                         messageIdsToDelete.push(+message.dataset.messageId);
                     }
                 }
@@ -136,7 +142,7 @@ window.chatsPageScript = async function chatsPageScript() {
             if (selectedMessages.length > 0) {
                 messageIdsToDelete = [];
                 for (let message of selectedMessages) {
-                    if (message.dataset.senderId == activeUserId || activeChatOwnerId == activeUserId) {
+                    if (message.dataset.senderId == activeUserId || canDeleteOthersMessages(message.dataset.senderId)) {
                         messageIdsToDelete.push(+message.dataset.messageId);
                     }
                 }
@@ -210,25 +216,153 @@ window.chatsPageScript = async function chatsPageScript() {
     let loadingMessages = false;
     let cachedUsers = new Map;
     let accessKey = localStorage.getItem('accessKey');
+    let refreshToken = localStorage.getItem('refreshToken');
+
+    // Tabs share one session, so only one of them at a time may rotate the refresh token,
+    // presenting an already rotated one logs the whole session out
+    async function refreshAccessKey() {
+        if (navigator.locks) {
+            await navigator.locks.request('refreshAccessKey', refreshAccessKeyExclusively);
+        } else {
+            await refreshAccessKeyExclusively();
+        }
+    }
+
+    async function refreshAccessKeyExclusively() {
+        // Another tab may have refreshed the key while this one was waiting
+        let storedDeathTs = localStorage.getItem('deathTs');
+        if (storedDeathTs * 1000 - 60000 > Date.now()) {
+            accessKey = localStorage.getItem('accessKey');
+            refreshToken = localStorage.getItem('refreshToken');
+            scheduleAccessKeyRefresh(storedDeathTs);
+            return;
+        }
+        refreshToken = localStorage.getItem('refreshToken');
+
+        let data = {};
+        try {
+            let response = await fetch('/refresh', {
+                method: 'POST',
+                body: JSON.stringify({
+                    refreshToken
+                })
+            });
+            data = await response.json();
+        } catch (e) {
+            console.log(e);
+            setTimeout(refreshAccessKey, 10000);
+            return;
+        }
+
+        if (!data.accessKey) {
+            localStorage.clear();
+            location.replace('/');
+            return;
+        }
+
+        accessKey = data.accessKey;
+        refreshToken = data.refreshToken;
+        localStorage.setItem('accessKey', data.accessKey);
+        localStorage.setItem('deathTs', data.deathTs);
+        localStorage.setItem('refreshToken', data.refreshToken);
+        scheduleAccessKeyRefresh(data.deathTs);
+    }
+
+    function scheduleAccessKeyRefresh(deathTs) {
+        // Refresh a minute before the access key dies, tabs are spread out
+        // so that without Web Locks the first one usually refreshes for everyone
+        let timeout = Math.max((deathTs - 60) * 1000 - Date.now() - Math.random() * 30000, 0);
+        setTimeout(refreshAccessKey, timeout);
+    }
+
+    // Picks up keys refreshed by other tabs
+    window.addEventListener('storage', function(e) {
+        if (e.key === 'accessKey' && e.newValue) {
+            accessKey = e.newValue;
+        } else if (e.key === 'refreshToken' && e.newValue) {
+            refreshToken = e.newValue;
+        }
+    });
+
+    if (localStorage.getItem('deathTs') * 1000 - 60000 < Date.now()) {
+        await refreshAccessKey();
+    } else {
+        scheduleAccessKeyRefresh(localStorage.getItem('deathTs'));
+    }
 
     let activeChatId = null;
-    let activeChatOwnerId = null;
+    let activeChatRole = null;
+    let activeChatMembers = new Map;
     let activeUserId = null;
 
+    const roleRanks = {owner: 4, admin: 3, moderator: 2, member: 1};
+
+    // Same rule as on the server: messages of members with lower roles,
+    // or of those who already left the chat
+    function canDeleteOthersMessages(senderId) {
+        if (!['owner', 'admin', 'moderator'].includes(activeChatRole)) {
+            return false;
+        }
+        let senderRole = activeChatMembers.get(+senderId);
+        return !senderRole || roleRanks[activeChatRole] > roleRanks[senderRole];
+    }
+
     let liveUpdates;
     try {
-        liveUpdates = await connectToLiveUpdates(accessKey);
+        liveUpdates = await connectToLiveUpdates(() => accessKey);
     } catch (e) {
         /* TODO: Add handling error on connection */
         console.log(e);
         return;
     }
     liveUpdates.addEventListener('error', console.log);
+
+    // Lets the server know user is not away
+    let lastActivityPing = 0;
+    function pingActivity() {
+        if (Date.now() - lastActivityPing > 60000) {
+            lastActivityPing = Date.now();
+            try {
+                liveUpdates.ping();
+            } catch (e) {
+                console.log(e);
+            }
+        }
+    }
+    document.addEventListener('keydown', pingActivity);
+    document.addEventListener('mousemove', pingActivity);
+    document.addEventListener('click', pingActivity);
+    liveUpdates.addEventListener('sessionRevoked', function() {
+        localStorage.clear();
+        location.replace('/');
+    });
     liveUpdates.addEventListener('newMessage', function(newMessage) {
         console.log(newMessage);
         if (activeChatId == newMessage.chatId) appendNewMessage(newMessage);
         notify(newMessage.chatId);
     });
+    liveUpdates.addEventListener('chatUpdated', function(eventData) {
+        console.log(eventData);
+        for (let chatButton of document.getElementsByClassName('chat-button')) {
+            if (+chatButton.dataset.chatId == eventData.chatId) {
+                chatButton.innerText = eventData.name[0].toUpperCase();
+                chatButton.title = eventData.name;
+            }
+        }
+        if (eventData.chatId == activeChatId) {
+            document.getElementById('chat-name').innerText = eventData.name;
+        }
+    });
+    liveUpdates.addEventListener('memberRoleChanged', function(eventData) {
+        console.log(eventData);
+        if (eventData.chatId != activeChatId) {
+            return;
+        }
+        activeChatMembers.set(eventData.userId, eventData.role);
+        if (eventData.userId == activeUserId) {
+            activeChatRole = eventData.role;
+        }
+    });
     liveUpdates.addEventListener('messagesDeleted', function(eventData) {
         console.log(eventData);
         if (eventData.chatId == activeChatId) {
@@ -237,34 +371,42 @@ window.chatsPageScript = async function chatsPageScript() {
             }
         }
     });
+    async function removeChat(chatId) {
+        let chatButtons = document.getElementsByClassName('chat-button');
+        for (let chatButton of chatButtons) {
+            if (+chatButton.dataset.chatId == chatId) {
+                chatButton.parentElement.removeChild(chatButton);
+                break;
+            }
+        }
+        if (chatId == activeChatId) {
+            let otherChatToBuild = document.getElementsByClassName('chat-button')[0];
+            if (otherChatToBuild.dataset.chatId) {
+                let chat = await getChat(+otherChatToBuild.dataset.chatId);
+                buildChat(chat);
+            } else {
+                let chatContainerElement = document.getElementById('chat-container');
+                chatContainerElement.dataset.chatId = '';
+                hideElement(chatContainerElement);
+                let chatContents = document.getElementById('chat-contents');
+                chatContents.innerHTML = '';
+            }
+        }
+    }
     liveUpdates.addEventListener('chatMemberLeft', async function(eventData) {
         console.log(eventData);
         if (eventData.userId == activeUserId) {
-            let chatButtons = document.getElementsByClassName('chat-button');
-            for (let chatButton of chatButtons) {
-                if (+chatButton.dataset.chatId == eventData.chatId) {
-                    chatButton.parentElement.removeChild(chatButton);
-                    break;
-                }
-            }
-            if (eventData.chatId == activeChatId) {
-                let otherChatToBuild = document.getElementsByClassName('chat-button')[0];
-                if (otherChatToBuild.dataset.chatId) {
-                    let chat = await getChat(+otherChatToBuild.dataset.chatId);
-                    buildChat(chat);
-                } else {
-                    let chatContainerElement = document.getElementById('chat-container');
-                    chatContainerElement.dataset.chatId = '';
-                    hideElement(chatContainerElement);
-                    let chatContents = document.getElementById('chat-contents');
-                    chatContents.innerHTML = '';
-                }
-            }
+            await removeChat(eventData.chatId);
         } else if (eventData.chatId == activeChatId) {
+            activeChatMembers.delete(eventData.userId);
             let membersCountElement = document.getElementById('members-count');
             membersCountElement.innerText -= 1;
         }
     });
+    liveUpdates.addEventListener('chatDeleted', async function(eventData) {
+        console.log(eventData);
+        await removeChat(eventData.chatId);
+    });
 
     messageInput.addEventListener('focus', function() {
         if (messageInput.classList.contains('not-touched')) {
@@ -466,7 +608,8 @@ window.chatsPageScript = async function chatsPageScript() {
         chatContainer.replaceChild(chatContents, oldChatContents);
 
         activeChatId = chat.id;
-        activeChatOwnerId = chat.ownerId;
+        activeChatMembers = new Map((chat.members || []).map(member => [member.id, member.role]));
+        activeChatRole = activeChatMembers.get(activeUserId) || null;
 
         let chatNameElement = document.getElementById('chat-name');
         let membersCountElement = document.getElementById('members-count');
@@ -1437,7 +1580,7 @@ window.chatsPageScript = async function chatsPageScript() {
         contextMenuElement.style.left = `${x}px`;
         contextMenuElement.style.top = `${y}px`;
 
-            if (senderId == activeUserId || activeChatOwnerId == activeUserId) {
+            if (senderId == activeUserId || canDeleteOthersMessages(senderId)) {
                 let deleteMessageButton = document.createElement('div');
                 deleteMessageButton.classList = 'context-menu-button';
                 deleteMessageButton.innerText = 'Delete message';
@@ -1584,6 +1727,17 @@ window.chatsPageScript = async function chatsPageScript() {
     }
 
     async function exitAccount() {
+        try {
+            await fetch('/logout', {
+                method: 'POST',
+                headers: {
+                    'Authorization': accessKey
+                }
+            });
+        } catch (e) {
+            console.log(e);
+        }
+        localStorage.clear();
         deleteCookie('authorized');
         location.replace('/');
     }
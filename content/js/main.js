@@ -527,14 +527,109 @@ window.mainPageScript = function mainPageScript() {
         if (data.accessKey) {
             localStorage.setItem('accessKey', data.accessKey);
             localStorage.setItem('deathTs', data.deathTs);
+            localStorage.setItem('refreshToken', data.refreshToken);
 
             await hideElement(menu);
             // location.replace('/chats');
             enterAccount()
+        } else if (data.totpRequired) {
+            buildTotpMenu(data.challenge);
         } else {
             buildLoginMenu(data.error);
         }
     }
+
+    async function buildTotpMenu(challenge, errorMessage) {
+        await hideElement(menu);
+
+        menu.innerHTML = '';
+        menu.classList = 'relative';
+
+        let backButton = document.createElement('div');
+        backButton.id = 'back-button';
+        backButton.innerHTML = '<img src="/assets/back-button.svg"></div>';
+        backButton.addEventListener('click', function() {
+            buildLoginMenu();
+        });
+
+        let dialogContainer = document.createElement('div');
+        dialogContainer.id = 'dialog-container';
+
+            let prompt = document.createElement('p');
+            prompt.id = 'prompt';
+            prompt.innerText = errorMessage ?? 'Please, enter code from authenticator app:';
+
+            let codeInput = document.createElement('input');
+            codeInput.classList = 'credentials-input';
+            codeInput.id = 'register-input';
+            codeInput.placeholder = 'code';
+            codeInput.autocomplete = 'one-time-code';
+            codeInput.spellcheck = false;
+
+        dialogContainer.appendChild(prompt);
+        dialogContainer.appendChild(codeInput);
+
+        let nextButton = document.createElement('div');
+        nextButton.id = 'next-button';
+        nextButton.classList = 'not-allowed';
+        nextButton.innerHTML = '<img src="/assets/next-button.svg"></div>';
+
+        async function submitCode() {
+            let data = {};
+            try {
+                let response = await fetch('/authTotp', {
+                    method: 'POST',
+                    body: JSON.stringify({
+                        challenge: challenge,
+                        code: codeInput.value
+                    })
+                });
+                data = await response.json();
+            } catch (err) {
+                console.log(err);
+                buildLoginMenu("Internal server error");
+                return;
+            }
+
+            if (data.accessKey) {
+                localStorage.setItem('accessKey', data.accessKey);
+                localStorage.setItem('deathTs', data.deathTs);
+                localStorage.setItem('refreshToken', data.refreshToken);
+
+                await hideElement(menu);
+                enterAccount();
+            } else if (data.error == 'Invalid code') {
+                buildTotpMenu(challenge, data.error);
+            } else {
+                buildLoginMenu(data.error);
+            }
+        }
+
+        codeInput.addEventListener('input', function() {
+            if (this.value.trim().length >= 6) {
+                nextButton.classList.remove('not-allowed');
+                nextButton.addEventListener('click', submitCode);
+            } else {
+                nextButton.classList.add('not-allowed');
+                nextButton.removeEventListener('click', submitCode);
+            }
+        });
+
+        codeInput.addEventListener('keydown', function(e) {
+            if (e.code == 'Enter') {
+                if (this.value.trim().length >= 6) {
+                    submitCode();
+                }
+            }
+        });
+
+        menu.appendChild(backButton);
+        menu.appendChild(dialogContainer);
+        menu.appendChild(nextButton);
+
+        await showElement(menu);
+        codeInput.focus();
+    }
     
     if (location.hash == '#login') {
         buildLoginMenu();
@@ -1,23 +1,242 @@
 package database
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"math"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 type DB struct {
 	Conn *sql.DB
 }
 
+/* Both *sql.DB and *sql.Tx, so the same helpers work inside transactions */
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 func (db *DB) Close() {
 	db.Conn.Close()
 }
 
+/* Algorithms stored in users.hash_algo.
+ * Rows created before hash_algo existed are sha256.
+ */
+const (
+	HashAlgoSha256 = "sha256"
+	HashAlgoBcrypt = "bcrypt"
+)
+
+/* Access keys are short-lived and renewed with refresh tokens,
+ * session lives as long as its refresh token is used within SessionLifetime
+ */
+var (
+	AccessKeyLifetime = time.Minute * 15
+	SessionLifetime   = time.Hour * 24 * 30
+)
+
+/* Same error for unknown names and wrong passwords,
+ * so they don't reveal which users and chats exist
+ */
+var (
+	ErrInvalidCredentials     = errors.New("Incorrect username or password")
+	ErrInvalidChatCredentials = errors.New("Incorrect chat name or password")
+	ErrInvalidChallenge       = errors.New("Invalid challenge")
+	ErrInvalidCode            = errors.New("Invalid code")
+	ErrUserBanned             = errors.New("User is banned")
+	ErrInvalidInvite          = errors.New("Invalid or expired invite")
+	ErrBannedFromChat         = errors.New("You are banned from this chat")
+)
+
+/* Compared against when the user doesn't exist,
+ * so such requests take as long as ones with a wrong password
+ */
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+/* Undelivered bot updates older than this are dropped */
+var BotUpdatesLifetime = time.Hour * 24
+
+/* Cost used for new bcrypt hashes.
+ * Hashes with a lower cost are re-hashed on the next successful login.
+ */
+var BcryptCost = bcrypt.DefaultCost
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), BcryptCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+/* Returns whether password matches the stored hash
+ * and whether the hash should be replaced with a fresh one
+ */
+func checkPassword(algo, hash, username string, registerTs int, password string) (bool, bool) {
+	switch algo {
+	case HashAlgoBcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err != nil {
+			return false, false
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return true, err != nil || cost < BcryptCost
+	case HashAlgoSha256:
+		legacyHash := sha256.Sum256([]byte(username + strconv.Itoa(registerTs) + password))
+		matches := subtle.ConstantTimeCompare([]byte(hex.EncodeToString(legacyHash[:])), []byte(hash)) == 1
+		return matches, true
+	}
+
+	return false, false
+}
+
+/* TOTP parameters (RFC 6238), the defaults every authenticator app supports */
+const (
+	TotpIssuer       = "Chatter"
+	totpPeriod       = 30
+	totpDigits       = 6
+	totpDrift        = 1
+	backupCodesCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func totpCode(secret []byte, step int64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+/* Returns the time step the code belongs to.
+ * Steps up to lastStep are rejected, so a code can't be used twice.
+ */
+func checkTotpCode(secret, code string, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	currentStep := time.Now().Unix() / totpPeriod
+	for step := currentStep - totpDrift; step <= currentStep+totpDrift; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func (db *DB) columnExists(table, column string) (bool, error) {
+	query := "SELECT COUNT(*) FROM information_schema.columns " +
+		"WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?"
+	var columnsCount int
+	err := db.Conn.QueryRow(query, table, column).Scan(&columnsCount)
+
+	return columnsCount > 0, err
+}
+
+func (db *DB) addColumnIfNotExists(table, column, definition string) error {
+	exists, err := db.columnExists(table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	query := "ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition
+	_, err = db.Conn.Exec(query)
+
+	return err
+}
+
+func (db *DB) addIndexIfNotExists(table, index, columns string) error {
+	return db.createIndexIfNotExists("INDEX", table, index, columns)
+}
+
+func (db *DB) addUniqueIndexIfNotExists(table, index, columns string) error {
+	return db.createIndexIfNotExists("UNIQUE INDEX", table, index, columns)
+}
+
+func (db *DB) indexExists(table, index string) (bool, error) {
+	query := "SELECT COUNT(*) FROM information_schema.statistics " +
+		"WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?"
+	var indexesCount int
+	err := db.Conn.QueryRow(query, table, index).Scan(&indexesCount)
+
+	return indexesCount > 0, err
+}
+
+func (db *DB) createIndexIfNotExists(kind, table, index, columns string) error {
+	exists, err := db.indexExists(table, index)
+	if err != nil || exists {
+		return err
+	}
+
+	query := "CREATE " + kind + " " + index + " ON " + table + " (" + columns + ")"
+	_, err = db.Conn.Exec(query)
+
+	return err
+}
+
+/* Full-text index over ngrams of the columns, for substring search.
+ * The ngram parser skips every token containing a stopword and the default list
+ * has "a" and "i", so stopwords are off in the session creating the index.
+ */
+func (db *DB) addNgramIndexIfNotExists(table, index, columns string) error {
+	exists, err := db.indexExists(table, index)
+	if err != nil || exists {
+		return err
+	}
+
+	/* Session variables need the same connection as the CREATE */
+	ctx := context.Background()
+	conn, err := db.Conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "SET SESSION innodb_ft_enable_stopword = OFF")
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "SET SESSION innodb_ft_enable_stopword = ON")
+
+	query := "CREATE FULLTEXT INDEX " + index + " ON " + table + " (" + columns + ") WITH PARSER ngram"
+	_, err = conn.ExecContext(ctx, query)
+
+	return err
+}
+
 func (db *DB) InitDatabase() error {
 	var (
 		query string
@@ -29,13 +248,71 @@ func (db *DB) InitDatabase() error {
 		"username VARCHAR(16) COLLATE utf8_bin UNIQUE, " +
 		"register_ts INT, " +
 		"hash VARCHAR(64), " +
-		"auth_done BOOLEAN " +
+		"auth_done BOOLEAN, " +
+		"hash_algo VARCHAR(16) NOT NULL DEFAULT '" + HashAlgoSha256 + "', " +
+		"deleted BOOLEAN NOT NULL DEFAULT FALSE, " +
+		"display_name VARCHAR(32) NOT NULL DEFAULT '', " +
+		"bio VARCHAR(256) NOT NULL DEFAULT '', " +
+		"avatar_hash VARCHAR(64) NOT NULL DEFAULT '', " +
+		"totp_secret VARCHAR(32) NOT NULL DEFAULT '', " +
+		"totp_enabled BOOLEAN NOT NULL DEFAULT FALSE, " +
+		"totp_last_step BIGINT NOT NULL DEFAULT 0, " +
+		"last_seen_ts INT NOT NULL DEFAULT 0, " +
+		"is_bot BOOLEAN NOT NULL DEFAULT FALSE, " +
+		"is_admin BOOLEAN NOT NULL DEFAULT FALSE, " +
+		"banned BOOLEAN NOT NULL DEFAULT FALSE, " +
+		"username_lower VARCHAR(16) AS (LOWER(username)) STORED, " +
+		"display_name_lower VARCHAR(32) AS (LOWER(display_name)) STORED " +
 		"); "
 	_, err = db.Conn.Exec(query)
 	if err != nil {
 		return err
 	}
 
+	err = db.addColumnIfNotExists("users", "hash_algo", "VARCHAR(16) NOT NULL DEFAULT '"+HashAlgoSha256+"'")
+	if err != nil {
+		return err
+	}
+
+	usersColumns := []struct {
+		Name       string
+		Definition string
+	}{
+		{"deleted", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"display_name", "VARCHAR(32) NOT NULL DEFAULT ''"},
+		{"bio", "VARCHAR(256) NOT NULL DEFAULT ''"},
+		{"avatar_hash", "VARCHAR(64) NOT NULL DEFAULT ''"},
+		{"totp_secret", "VARCHAR(32) NOT NULL DEFAULT ''"},
+		{"totp_enabled", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"totp_last_step", "BIGINT NOT NULL DEFAULT 0"},
+		{"last_seen_ts", "INT NOT NULL DEFAULT 0"},
+		{"is_bot", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"is_admin", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"banned", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"username_lower", "VARCHAR(16) AS (LOWER(username)) STORED"},
+		{"display_name_lower", "VARCHAR(32) AS (LOWER(display_name)) STORED"},
+	}
+	for _, column := range usersColumns {
+		err = db.addColumnIfNotExists("users", column.Name, column.Definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	/* For case-insensitive search */
+	err = db.addIndexIfNotExists("users", "users_username_lower", "username_lower")
+	if err != nil {
+		return err
+	}
+	err = db.addIndexIfNotExists("users", "users_display_name_lower", "display_name_lower")
+	if err != nil {
+		return err
+	}
+	err = db.addNgramIndexIfNotExists("users", "users_names_ngram", "username_lower, display_name_lower")
+	if err != nil {
+		return err
+	}
+
 	query = "SELECT COUNT(*) FROM users"
 	queryResult := db.Conn.QueryRow(query)
 	var usersCount int
@@ -53,6 +330,10 @@ func (db *DB) InitDatabase() error {
 		"last_message_ts INT, " +
 		"messages_count INT, " +
 		"members_count INT, " +
+		"dm_user1_id INT, " +
+		"dm_user2_id INT, " +
+		"description VARCHAR(256) NOT NULL DEFAULT '', " +
+		"hash_name VARCHAR(64), " +
 		"FOREIGN KEY (owner_id) REFERENCES users (id) " +
 		"); "
 	_, err = db.Conn.Exec(query)
@@ -60,10 +341,34 @@ func (db *DB) InitDatabase() error {
 		return err
 	}
 
+	/* Direct chats have no name and password, only the pair of their users */
+	chatsColumns := []struct {
+		Name       string
+		Definition string
+	}{
+		{"dm_user1_id", "INT"},
+		{"dm_user2_id", "INT"},
+		{"description", "VARCHAR(256) NOT NULL DEFAULT ''"},
+		{"hash_name", "VARCHAR(64)"},
+	}
+	for _, column := range chatsColumns {
+		err = db.addColumnIfNotExists("chats", column.Name, column.Definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	/* One direct chat per pair, dm_user1_id is the lower id */
+	err = db.addUniqueIndexIfNotExists("chats", "chats_dm_users", "dm_user1_id, dm_user2_id")
+	if err != nil {
+		return err
+	}
+
 	query = "CREATE TABLE IF NOT EXISTS chats_members ( " +
 		"chat_id INT, " +
 		"member_id INT, " +
-		"is_owner BOOLEAN, " +
+		"role VARCHAR(16) NOT NULL DEFAULT '" + RoleMember + "', " +
+		"join_ts INT NOT NULL DEFAULT 0, " +
 		"PRIMARY KEY (chat_id, member_id), " +
 		"FOREIGN KEY (chat_id) REFERENCES chats (id), " +
 		"FOREIGN KEY (member_id) REFERENCES users (id) " +
@@ -73,11 +378,70 @@ func (db *DB) InitDatabase() error {
 		return err
 	}
 
+	chatsMembersColumns := []struct {
+		Name       string
+		Definition string
+	}{
+		{"role", "VARCHAR(16) NOT NULL DEFAULT '" + RoleMember + "'"},
+		{"join_ts", "INT NOT NULL DEFAULT 0"},
+	}
+	for _, column := range chatsMembersColumns {
+		err = db.addColumnIfNotExists("chats_members", column.Name, column.Definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	/* Owners from before roles. The role is the only place ownership is kept in
+	 * chats_members, so the is_owner flag goes away once it's carried over.
+	 */
+	isOwnerExists, err := db.columnExists("chats_members", "is_owner")
+	if err != nil {
+		return err
+	}
+	if isOwnerExists {
+		query = "UPDATE chats_members SET role = '" + RoleOwner + "' WHERE is_owner AND role != '" + RoleOwner + "'"
+		_, err = db.Conn.Exec(query)
+		if err != nil {
+			return err
+		}
+
+		query = "ALTER TABLE chats_members DROP COLUMN is_owner"
+		_, err = db.Conn.Exec(query)
+		if err != nil {
+			return err
+		}
+	}
+
+	/* Access keys used to be derived from the password and keyed by (user_id, death_ts).
+	 * Such keys can't be validated anymore, so the old table is recreated.
+	 */
+	query = "SELECT COUNT(*) FROM information_schema.key_column_usage " +
+		"WHERE table_schema = DATABASE() AND table_name = 'access_keys' " +
+		"AND constraint_name = 'PRIMARY' AND column_name = 'death_ts'"
+	var legacyAccessKeys int
+	err = db.Conn.QueryRow(query).Scan(&legacyAccessKeys)
+	if err != nil {
+		return err
+	}
+	if legacyAccessKeys > 0 {
+		_, err = db.Conn.Exec("DROP TABLE access_keys")
+		if err != nil {
+			return err
+		}
+	}
+
 	query = "CREATE TABLE IF NOT EXISTS access_keys ( " +
+		"hash VARCHAR(64) PRIMARY KEY, " +
 		"user_id INT, " +
 		"death_ts INT, " +
-		"hash VARCHAR(64), " +
-		"PRIMARY KEY (user_id, death_ts), " +
+		"id INT AUTO_INCREMENT UNIQUE, " +
+		"create_ts INT, " +
+		"user_agent VARCHAR(256), " +
+		"ip VARCHAR(45), " +
+		"refresh_hash VARCHAR(64) UNIQUE, " +
+		"refresh_death_ts INT, " +
+		"INDEX (user_id), " +
 		"FOREIGN KEY (user_id) REFERENCES users (id) " +
 		"); "
 	_, err = db.Conn.Exec(query)
@@ -85,263 +449,2429 @@ func (db *DB) InitDatabase() error {
 		return err
 	}
 
-	query = "CREATE TABLE IF NOT EXISTS messages ( " +
-		"chat_id INT, " +
-		"message_id INT AUTO_INCREMENT, " +
-		"sender_id INT, " +
-		"ts INT, " +
-		"text VARCHAR(2048), " +
-		"PRIMARY KEY (chat_id, message_id), " +
-		"FOREIGN KEY (chat_id) REFERENCES chats (id), " +
-		"FOREIGN KEY (sender_id) REFERENCES users (id) " +
-		") ENGINE=MyISAM; "
+	accessKeysColumns := []struct {
+		Name       string
+		Definition string
+	}{
+		{"id", "INT AUTO_INCREMENT UNIQUE"},
+		{"create_ts", "INT"},
+		{"user_agent", "VARCHAR(256)"},
+		{"ip", "VARCHAR(45)"},
+		{"refresh_hash", "VARCHAR(64) UNIQUE"},
+		{"refresh_death_ts", "INT"},
+	}
+	for _, column := range accessKeysColumns {
+		err = db.addColumnIfNotExists("access_keys", column.Name, column.Definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	/* Keys created before refresh tokens end with their access key */
+	query = "UPDATE access_keys SET refresh_death_ts = death_ts WHERE refresh_death_ts IS NULL"
 	_, err = db.Conn.Exec(query)
 	if err != nil {
 		return err
 	}
 
-	query = "CREATE TABLE IF NOT EXISTS messages_attachments ( " +
-		"chat_id INT, " +
-		"message_id INT, " +
-		"type VARCHAR(64), " +
+	/* Rotated refresh tokens are kept to detect their reuse */
+	query = "CREATE TABLE IF NOT EXISTS used_refresh_tokens ( " +
+		"hash VARCHAR(64) PRIMARY KEY, " +
+		"session_id INT, " +
+		"death_ts INT " +
+		"); "
+	_, err = db.Conn.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	/* Logins waiting for a TOTP code */
+	query = "CREATE TABLE IF NOT EXISTS auth_challenges ( " +
+		"hash VARCHAR(64) PRIMARY KEY, " +
+		"user_id INT, " +
+		"death_ts INT, " +
+		"failed_attempts INT NOT NULL DEFAULT 0, " +
+		"FOREIGN KEY (user_id) REFERENCES users (id) " +
+		"); "
+	_, err = db.Conn.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	query = "CREATE TABLE IF NOT EXISTS totp_backup_codes ( " +
+		"user_id INT, " +
 		"hash VARCHAR(64), " +
-		"FOREIGN KEY (chat_id) REFERENCES chats (id), " +
-		"FOREIGN KEY (message_id) REFERENCES messages (message_id) " +
-		") ENGINE=MyISAM; "
+		"PRIMARY KEY (user_id, hash), " +
+		"FOREIGN KEY (user_id) REFERENCES users (id) " +
+		"); "
 	_, err = db.Conn.Exec(query)
 	if err != nil {
 		return err
 	}
 
-	/* If database just created */
-	if usersCount == 0 {
-		query = "INSERT INTO users VALUES " +
-			"(0, 'starterBot', 0, 'my-hash-is-unhackable', 1)"
-		result, err := db.Conn.Exec(query)
-		if err != nil {
-			return err
-		}
-		starterBotId, _ := result.LastInsertId()
+	query = "CREATE TABLE IF NOT EXISTS password_reset_codes ( " +
+		"hash VARCHAR(64) PRIMARY KEY, " +
+		"user_id INT, " +
+		"death_ts INT, " +
+		"FOREIGN KEY (user_id) REFERENCES users (id) " +
+		"); "
+	_, err = db.Conn.Exec(query)
+	if err != nil {
+		return err
+	}
 
-		starterChatId, err := db.CreateChat(int(starterBotId), "starterChat", "starterChat")
-		if err != nil {
-			return err
-		}
+	query = "CREATE TABLE IF NOT EXISTS blocks ( " +
+		"blocker_id INT, " +
+		"blocked_id INT, " +
+		"create_ts INT, " +
+		"PRIMARY KEY (blocker_id, blocked_id), " +
+		"INDEX (blocked_id), " +
+		"FOREIGN KEY (blocker_id) REFERENCES users (id), " +
+		"FOREIGN KEY (blocked_id) REFERENCES users (id) " +
+		"); "
+	_, err = db.Conn.Exec(query)
+	if err != nil {
+		return err
+	}
 
-		starterChatMessage1 := "Hello! Cool that you registered!\n " +
-			"I created this chat in case you are alone and there is no people you could talk to. " +
-			"I will listen to you, but won’t answer."
-		starterChatMessage2 := "If you not alone and have people to talk to, " +
-			"you may be interested in how to create your own chat. " +
-			"Here is the answer: on the left panel there is the button with «+» sign."
+	/* Bots are users with is_bot set, authenticated with a token instead of a password */
+	query = "CREATE TABLE IF NOT EXISTS bots ( " +
+		"user_id INT PRIMARY KEY, " +
+		"owner_id INT, " +
+		"token_hash VARCHAR(64) UNIQUE, " +
+		"webhook_url VARCHAR(512) NOT NULL DEFAULT '', " +
+		"create_ts INT, " +
+		"INDEX (owner_id), " +
+		"FOREIGN KEY (user_id) REFERENCES users (id), " +
+		"FOREIGN KEY (owner_id) REFERENCES users (id) " +
+		"); "
+	_, err = db.Conn.Exec(query)
+	if err != nil {
+		return err
+	}
 
-		db.AddMessage(starterChatId, int(starterBotId), starterChatMessage1)
-		db.AddMessage(starterChatId, int(starterBotId), starterChatMessage2)
+	/* Events of bots' chats, until bots confirm them or webhooks accept them.
+	 * chat_id is the chat the update goes away with, NULL outlives the chat.
+	 */
+	query = "CREATE TABLE IF NOT EXISTS bot_updates ( " +
+		"id INT AUTO_INCREMENT PRIMARY KEY, " +
+		"bot_id INT, " +
+		"chat_id INT, " +
+		"payload TEXT, " +
+		"create_ts INT, " +
+		"INDEX (bot_id, id), " +
+		"INDEX (chat_id), " +
+		"FOREIGN KEY (bot_id) REFERENCES users (id) " +
+		"); "
+	_, err = db.Conn.Exec(query)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	err = db.addColumnIfNotExists("bot_updates", "chat_id", "INT")
+	if err != nil {
+		return err
+	}
+	err = db.addIndexIfNotExists("bot_updates", "chat_id", "chat_id")
+	if err != nil {
+		return err
+	}
+
+	query = "CREATE TABLE IF NOT EXISTS chat_bans ( " +
+		"chat_id INT, " +
+		"user_id INT, " +
+		"banned_by INT, " +
+		"create_ts INT, " +
+		"PRIMARY KEY (chat_id, user_id), " +
+		"FOREIGN KEY (chat_id) REFERENCES chats (id), " +
+		"FOREIGN KEY (user_id) REFERENCES users (id) " +
+		"); "
+	_, err = db.Conn.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	/* Zero death_ts and max_uses mean no limit */
+	query = "CREATE TABLE IF NOT EXISTS chat_invites ( " +
+		"id INT AUTO_INCREMENT PRIMARY KEY, " +
+		"chat_id INT, " +
+		"creator_id INT, " +
+		"hash VARCHAR(64) UNIQUE, " +
+		"create_ts INT, " +
+		"death_ts INT NOT NULL DEFAULT 0, " +
+		"max_uses INT NOT NULL DEFAULT 0, " +
+		"uses INT NOT NULL DEFAULT 0, " +
+		"revoked BOOLEAN NOT NULL DEFAULT FALSE, " +
+		"INDEX (chat_id), " +
+		"FOREIGN KEY (chat_id) REFERENCES chats (id), " +
+		"FOREIGN KEY (creator_id) REFERENCES users (id) " +
+		"); "
+	_, err = db.Conn.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	/* Personal API tokens, scopes and chat ids are comma-separated, empty chat_ids means all chats */
+	query = "CREATE TABLE IF NOT EXISTS api_tokens ( " +
+		"id INT AUTO_INCREMENT PRIMARY KEY, " +
+		"user_id INT, " +
+		"name VARCHAR(64), " +
+		"hash VARCHAR(64) UNIQUE, " +
+		"scopes VARCHAR(256), " +
+		"chat_ids VARCHAR(1024) NOT NULL DEFAULT '', " +
+		"create_ts INT, " +
+		"last_used_ts INT NOT NULL DEFAULT 0, " +
+		"INDEX (user_id), " +
+		"FOREIGN KEY (user_id) REFERENCES users (id) " +
+		"); "
+	_, err = db.Conn.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	/* starterBot used to be an ordinary user with a fake password hash */
+	query = "UPDATE users SET is_bot = TRUE, hash = NULL " +
+		"WHERE username = 'starterBot' AND register_ts = 0 AND NOT is_bot"
+	_, err = db.Conn.Exec(query)
+	if err != nil {
+		return err
+	}
+	query = "INSERT IGNORE INTO bots (`user_id`, `create_ts`) " +
+		"SELECT id, register_ts FROM users WHERE username = 'starterBot' AND register_ts = 0"
+	_, err = db.Conn.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	query = "CREATE TABLE IF NOT EXISTS messages ( " +
+		"chat_id INT, " +
+		"message_id INT AUTO_INCREMENT, " +
+		"sender_id INT, " +
+		"ts INT, " +
+		"text VARCHAR(2048), " +
+		"PRIMARY KEY (chat_id, message_id), " +
+		"FOREIGN KEY (chat_id) REFERENCES chats (id), " +
+		"FOREIGN KEY (sender_id) REFERENCES users (id) " +
+		") ENGINE=MyISAM; "
+	_, err = db.Conn.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	/* Memberships from before join_ts joined no later than their first message in the chat,
+	 * members who never posted are taken as joined when the chat was created.
+	 * Runs only here, once the messages table exists.
+	 */
+	query = "UPDATE chats_members INNER JOIN chats ON chats.id = chats_members.chat_id " +
+		"SET chats_members.join_ts = IFNULL((SELECT MIN(messages.ts) FROM messages " +
+		"WHERE messages.chat_id = chats_members.chat_id AND messages.sender_id = chats_members.member_id), chats.create_ts) " +
+		"WHERE chats_members.join_ts = 0"
+	_, err = db.Conn.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	query = "CREATE TABLE IF NOT EXISTS messages_attachments ( " +
+		"chat_id INT, " +
+		"message_id INT, " +
+		"type VARCHAR(64), " +
+		"hash VARCHAR(64), " +
+		"FOREIGN KEY (chat_id) REFERENCES chats (id), " +
+		"FOREIGN KEY (message_id) REFERENCES messages (message_id) " +
+		") ENGINE=MyISAM; "
+	_, err = db.Conn.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	/* If database just created */
+	if usersCount == 0 {
+		query = "INSERT INTO users " +
+			"(`id`, `username`, `register_ts`, `auth_done`, `is_bot`) " +
+			"VALUES (0, 'starterBot', 0, TRUE, TRUE)"
+		result, err := db.Conn.Exec(query)
+		if err != nil {
+			return err
+		}
+		starterBotId, _ := result.LastInsertId()
+
+		query = "INSERT INTO bots (`user_id`, `create_ts`) VALUES (?, 0)"
+		_, err = db.Conn.Exec(query, starterBotId)
+		if err != nil {
+			return err
+		}
+
+		starterChatId, err := db.CreateChat(int(starterBotId), "starterChat", "starterChat")
+		if err != nil {
+			return err
+		}
+
+		starterChatMessage1 := "Hello! Cool that you registered!\n " +
+			"I created this chat in case you are alone and there is no people you could talk to. " +
+			"I will listen to you, but won’t answer."
+		starterChatMessage2 := "If you not alone and have people to talk to, " +
+			"you may be interested in how to create your own chat. " +
+			"Here is the answer: on the left panel there is the button with «+» sign."
+
+		db.AddMessage(starterChatId, int(starterBotId), starterChatMessage1)
+		db.AddMessage(starterChatId, int(starterBotId), starterChatMessage2)
+	}
+
+	return nil
+}
+
+func (db *DB) RegisterUser(username, password string) (int, error) {
+	query := "INSERT INTO users " +
+		"(`username`, `register_ts`, `hash`, `hash_algo`, `auth_done`) " +
+		"VALUES (?, ?, ?, ?, FALSE)"
+
+	registerTs := int(time.Now().Unix())
+	hash, err := hashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := db.Conn.Exec(query, username, registerTs, hash, HashAlgoBcrypt)
+	if err != nil {
+		return 0, err
+	}
+
+	userId, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(userId), nil
+}
+
+type User struct {
+	Id          int    `json:"id"`
+	Username    string `json:"username"`
+	RegisterTs  int    `json:"registerTs"`
+	DisplayName string `json:"displayName"`
+	Bio         string `json:"bio"`
+	AvatarHash  string `json:"avatarHash"`
+	Status      string `json:"status"`
+	LastSeenTs  int    `json:"lastSeenTs"`
+	IsBot       bool   `json:"isBot"`
+}
+
+/* Deleted users keep their rows so their messages stay in place */
+const DeletedUsername = "Deleted user"
+
+func (db *DB) GetUser(userId int) (User, bool) {
+	query := "SELECT IF(deleted, '" + DeletedUsername + "', username), register_ts, display_name, bio, avatar_hash, last_seen_ts, is_bot " +
+		"FROM users WHERE id = ?"
+	row := db.Conn.QueryRow(query, userId)
+
+	user := User{Id: userId}
+	err := row.Scan(&user.Username, &user.RegisterTs, &user.DisplayName, &user.Bio, &user.AvatarHash, &user.LastSeenTs, &user.IsBot)
+	if err != nil {
+		log.Println(err)
+		return user, false
+	}
+
+	return user, true
+}
+
+/* For user-provided LIKE patterns */
+var likeEscaper = strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+
+/* Case-insensitive search by username and display name, users whose names
+ * start with the query go first. Prefixes are found with the plain indexes,
+ * substrings with the ngram index, a leading wildcard would scan the whole table.
+ * Ngram matches are only candidates and are checked with LIKE, queries shorter
+ * than ngram_token_size (2 by default) find prefixes only.
+ */
+func (db *DB) SearchUsers(callerId int, searchQuery string, offset, count int) ([]User, error) {
+	escaped := likeEscaper.Replace(strings.ToLower(searchQuery))
+	prefix := escaped + "%"
+	substring := "%" + escaped + "%"
+	/* A quoted phrase keeps the ngrams in order */
+	phrase := `"` + strings.ReplaceAll(strings.ToLower(searchQuery), `"`, "") + `"`
+
+	query := "SELECT users.id, users.username, users.register_ts, users.display_name, users.bio, " +
+		"users.avatar_hash, users.last_seen_ts, users.is_bot " +
+		"FROM users INNER JOIN (" +
+		"SELECT id FROM users WHERE username_lower LIKE ? " +
+		"UNION SELECT id FROM users WHERE display_name_lower LIKE ? " +
+		"UNION SELECT id FROM users WHERE MATCH (username_lower, display_name_lower) AGAINST (? IN BOOLEAN MODE)" +
+		") matches ON matches.id = users.id " +
+		"WHERE NOT users.deleted AND (users.username_lower LIKE ? OR users.display_name_lower LIKE ?) " +
+		"AND users.id NOT IN (SELECT blocker_id FROM blocks WHERE blocked_id = ?) " +
+		"ORDER BY users.username_lower LIKE ? DESC, users.display_name_lower LIKE ? DESC, users.username_lower " +
+		"LIMIT ? OFFSET ?"
+	rows, err := db.Conn.Query(query, prefix, prefix, phrase, substring, substring, callerId, prefix, prefix, count, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		err = rows.Scan(&user.Id, &user.Username, &user.RegisterTs, &user.DisplayName, &user.Bio, &user.AvatarHash, &user.LastSeenTs, &user.IsBot)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+func (db *DB) CreateBot(ownerId int, username string) (User, string, error) {
+	query := "INSERT INTO users " +
+		"(`username`, `register_ts`, `auth_done`, `is_bot`) " +
+		"VALUES (?, ?, TRUE, TRUE)"
+	registerTs := int(time.Now().Unix())
+	result, err := db.Conn.Exec(query, username, registerTs)
+	if err != nil {
+		return User{}, "", errors.New("Username already taken")
+	}
+
+	botId, err := result.LastInsertId()
+	if err != nil {
+		return User{}, "", err
+	}
+
+	token, err := generateAccessKey()
+	if err != nil {
+		return User{}, "", err
+	}
+
+	query = "INSERT INTO bots " +
+		"(`user_id`, `owner_id`, `token_hash`, `create_ts`) " +
+		"VALUES (?, ?, ?, ?)"
+	_, err = db.Conn.Exec(query, botId, ownerId, hashAccessKey(token), registerTs)
+	if err != nil {
+		return User{}, "", err
+	}
+
+	bot, _ := db.GetUser(int(botId))
+
+	return bot, token, nil
+}
+
+func (db *DB) GetUserBots(ownerId int) ([]User, error) {
+	query := "SELECT users.id, users.username, users.register_ts, " +
+		"users.display_name, users.bio, users.avatar_hash, users.last_seen_ts, users.is_bot " +
+		"FROM bots INNER JOIN users ON users.id = bots.user_id " +
+		"WHERE bots.owner_id = ? AND NOT users.deleted " +
+		"ORDER BY bots.create_ts"
+	rows, err := db.Conn.Query(query, ownerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bots := []User{}
+	for rows.Next() {
+		var bot User
+		err = rows.Scan(&bot.Id, &bot.Username, &bot.RegisterTs, &bot.DisplayName, &bot.Bio, &bot.AvatarHash, &bot.LastSeenTs, &bot.IsBot)
+		if err != nil {
+			return nil, err
+		}
+		bots = append(bots, bot)
+	}
+
+	return bots, nil
+}
+
+/* Replaces the bot token, the old one stops working */
+func (db *DB) RegenerateBotToken(ownerId, botId int) (string, error) {
+	query := "SELECT user_id FROM bots WHERE user_id = ? AND owner_id = ?"
+	err := db.Conn.QueryRow(query, botId, ownerId).Scan(&botId)
+	if err != nil {
+		return "", errors.New("Bot not found")
+	}
+
+	return db.setBotToken(botId)
+}
+
+/* For bots without an owner, such as starterBot */
+func (db *DB) IssueBotToken(username string) (string, error) {
+	query := "SELECT bots.user_id FROM bots INNER JOIN users ON users.id = bots.user_id " +
+		"WHERE users.username = ?"
+	var botId int
+	err := db.Conn.QueryRow(query, username).Scan(&botId)
+	if err != nil {
+		return "", errors.New("Bot not found")
+	}
+
+	return db.setBotToken(botId)
+}
+
+func (db *DB) setBotToken(botId int) (string, error) {
+	token, err := generateAccessKey()
+	if err != nil {
+		return "", err
+	}
+
+	query := "UPDATE bots SET token_hash = ? WHERE user_id = ?"
+	_, err = db.Conn.Exec(query, hashAccessKey(token), botId)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+/* Bots stop working together with their owners, bots without an owner are left alone */
+func (db *DB) ValidateBotToken(token string) (bool, int) {
+	query := "SELECT bots.user_id FROM bots INNER JOIN users ON users.id = bots.user_id " +
+		"LEFT JOIN users owners ON owners.id = bots.owner_id " +
+		"WHERE bots.token_hash = ? AND NOT users.deleted AND NOT users.banned " +
+		"AND (bots.owner_id IS NULL OR (NOT owners.deleted AND NOT owners.banned))"
+	var botId int
+	err := db.Conn.QueryRow(query, hashAccessKey(token)).Scan(&botId)
+	if err != nil {
+		return false, 0
+	}
+
+	return true, botId
+}
+
+func (db *DB) IsBot(userId int) bool {
+	query := "SELECT is_bot FROM users WHERE id = ?"
+	var isBot bool
+	err := db.Conn.QueryRow(query, userId).Scan(&isBot)
+
+	return err == nil && isBot
+}
+
+func (db *DB) SetBotWebhook(botId int, url string) error {
+	query := "UPDATE bots SET webhook_url = ? WHERE user_id = ?"
+	_, err := db.Conn.Exec(query, url, botId)
+
+	return err
+}
+
+func (db *DB) GetBotWebhook(botId int) string {
+	query := "SELECT webhook_url FROM bots WHERE user_id = ?"
+	var url string
+	db.Conn.QueryRow(query, botId).Scan(&url)
+
+	return url
+}
+
+/* Queues the event for bots which are members of any of the chats,
+ * returns ids of these bots
+ */
+func (db *DB) AddBotUpdates(chatId int, payload []byte, excludedUserIds map[int]bool) ([]int, error) {
+	return db.addBotUpdates(chatId, chatId, payload, excludedUserIds)
+}
+
+/* Queues the payload for bots in the chat, returns their ids.
+ * The updates are deleted with boundChatId, 0 keeps them after the chat is gone.
+ */
+func (db *DB) addBotUpdates(chatId, boundChatId int, payload []byte, excludedUserIds map[int]bool) ([]int, error) {
+	query := "SELECT chats_members.member_id " +
+		"FROM chats_members INNER JOIN users ON users.id = chats_members.member_id " +
+		"WHERE users.is_bot AND chats_members.chat_id = ?"
+	rows, err := db.Conn.Query(query, chatId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	botIds := []int{}
+	for rows.Next() {
+		var botId int
+		err = rows.Scan(&botId)
+		if err != nil {
+			return nil, err
+		}
+		if !excludedUserIds[botId] {
+			botIds = append(botIds, botId)
+		}
+	}
+
+	query = "INSERT INTO bot_updates " +
+		"(`bot_id`, `chat_id`, `payload`, `create_ts`) " +
+		"VALUES (?, NULLIF(?, 0), ?, ?)"
+	ts := time.Now().Unix()
+	for _, botId := range botIds {
+		_, err = db.Conn.Exec(query, botId, boundChatId, string(payload), ts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return botIds, nil
+}
+
+type BotUpdate struct {
+	Id      int             `json:"updateId"`
+	Payload json.RawMessage `json:"update"`
+}
+
+/* Updates with ids below offset are confirmed by the bot and deleted */
+func (db *DB) GetBotUpdates(botId, offset, limit int) ([]BotUpdate, error) {
+	query := "DELETE FROM bot_updates WHERE bot_id = ? AND id < ?"
+	_, err := db.Conn.Exec(query, botId, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	query = "SELECT id, payload FROM bot_updates " +
+		"WHERE bot_id = ? AND id >= ? " +
+		"ORDER BY id LIMIT ?"
+	rows, err := db.Conn.Query(query, botId, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	updates := []BotUpdate{}
+	for rows.Next() {
+		var (
+			update  BotUpdate
+			payload string
+		)
+		err = rows.Scan(&update.Id, &payload)
+		if err != nil {
+			return nil, err
+		}
+		update.Payload = json.RawMessage(payload)
+		updates = append(updates, update)
+	}
+
+	return updates, nil
+}
+
+func (db *DB) DeleteBotUpdate(botId, updateId int) error {
+	query := "DELETE FROM bot_updates WHERE bot_id = ? AND id = ? LIMIT 1"
+	_, err := db.Conn.Exec(query, botId, updateId)
+
+	return err
+}
+
+/* Bots with webhooks which still have undelivered updates */
+func (db *DB) GetBotsWithPendingWebhooks() ([]int, error) {
+	query := "SELECT DISTINCT bots.user_id FROM bots " +
+		"INNER JOIN bot_updates ON bot_updates.bot_id = bots.user_id " +
+		"WHERE bots.webhook_url != ''"
+	rows, err := db.Conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	botIds := []int{}
+	for rows.Next() {
+		var botId int
+		err = rows.Scan(&botId)
+		if err != nil {
+			return nil, err
+		}
+		botIds = append(botIds, botId)
+	}
+
+	return botIds, nil
+}
+
+/* Scopes of personal API tokens */
+const (
+	ScopeReadMessages   = "read-messages"
+	ScopeSendMessages   = "send-messages"
+	ScopeDeleteMessages = "delete-messages"
+	ScopeManageChats    = "manage-chats"
+)
+
+var ApiTokenScopes = []string{ScopeReadMessages, ScopeSendMessages, ScopeDeleteMessages, ScopeManageChats}
+
+const MaxApiTokens = 20
+
+type ApiToken struct {
+	Id         int      `json:"id"`
+	UserId     int      `json:"-"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	ChatIds    []int    `json:"chatIds"`
+	CreateTs   int      `json:"createTs"`
+	LastUsedTs int      `json:"lastUsedTs"`
+}
+
+func (token *ApiToken) HasScope(scope string) bool {
+	for _, tokenScope := range token.Scopes {
+		if tokenScope == scope {
+			return true
+		}
+	}
+	return false
+}
+
+/* Empty ChatIds means the token isn't limited to some chats */
+func (token *ApiToken) AllowsChat(chatId int) bool {
+	if len(token.ChatIds) == 0 {
+		return true
+	}
+	for _, tokenChatId := range token.ChatIds {
+		if tokenChatId == chatId {
+			return true
+		}
+	}
+	return false
+}
+
+func joinInts(values []int) string {
+	strs := make([]string, len(values))
+	for i, value := range values {
+		strs[i] = strconv.Itoa(value)
+	}
+	return strings.Join(strs, ",")
+}
+
+func splitInts(joined string) []int {
+	values := []int{}
+	if joined == "" {
+		return values
+	}
+	for _, str := range strings.Split(joined, ",") {
+		value, err := strconv.Atoi(str)
+		if err == nil {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func splitScopes(joined string) []string {
+	if joined == "" {
+		return []string{}
+	}
+	return strings.Split(joined, ",")
+}
+
+/* Returns the token itself, only its hash is stored */
+func (db *DB) CreateApiToken(userId int, name string, scopes []string, chatIds []int) (string, ApiToken, error) {
+	query := "SELECT COUNT(*) FROM api_tokens WHERE user_id = ?"
+	var tokensCount int
+	err := db.Conn.QueryRow(query, userId).Scan(&tokensCount)
+	if err != nil {
+		return "", ApiToken{}, err
+	}
+	if tokensCount >= MaxApiTokens {
+		return "", ApiToken{}, errors.New("Too many tokens")
+	}
+
+	for _, scope := range scopes {
+		known := false
+		for _, knownScope := range ApiTokenScopes {
+			known = known || scope == knownScope
+		}
+		if !known {
+			return "", ApiToken{}, errors.New("Unknown scope")
+		}
+	}
+
+	for _, chatId := range chatIds {
+		if !db.IsUserInChat(userId, chatId) {
+			return "", ApiToken{}, errors.New("Chat not found")
+		}
+	}
+
+	token, err := generateAccessKey()
+	if err != nil {
+		return "", ApiToken{}, err
+	}
+
+	apiToken := ApiToken{
+		UserId:   userId,
+		Name:     name,
+		Scopes:   scopes,
+		ChatIds:  chatIds,
+		CreateTs: int(time.Now().Unix()),
+	}
+
+	query = "INSERT INTO api_tokens " +
+		"(`user_id`, `name`, `hash`, `scopes`, `chat_ids`, `create_ts`) " +
+		"VALUES (?, ?, ?, ?, ?, ?)"
+	result, err := db.Conn.Exec(query, userId, name, hashAccessKey(token),
+		strings.Join(scopes, ","), joinInts(chatIds), apiToken.CreateTs)
+	if err != nil {
+		return "", ApiToken{}, err
+	}
+
+	tokenId, err := result.LastInsertId()
+	if err != nil {
+		return "", ApiToken{}, err
+	}
+	apiToken.Id = int(tokenId)
+
+	return token, apiToken, nil
+}
+
+func (db *DB) GetApiTokens(userId int) ([]ApiToken, error) {
+	query := "SELECT id, name, scopes, chat_ids, create_ts, last_used_ts " +
+		"FROM api_tokens WHERE user_id = ? ORDER BY id"
+	rows, err := db.Conn.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []ApiToken{}
+	for rows.Next() {
+		token := ApiToken{UserId: userId}
+		var scopes, chatIds string
+		err = rows.Scan(&token.Id, &token.Name, &scopes, &chatIds, &token.CreateTs, &token.LastUsedTs)
+		if err != nil {
+			return nil, err
+		}
+		token.Scopes = splitScopes(scopes)
+		token.ChatIds = splitInts(chatIds)
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
+}
+
+func (db *DB) RevokeApiToken(userId, tokenId int) error {
+	query := "DELETE FROM api_tokens WHERE id = ? AND user_id = ?"
+	result, err := db.Conn.Exec(query, tokenId, userId)
+	if err != nil {
+		return err
+	}
+	if deletedCount, _ := result.RowsAffected(); deletedCount == 0 {
+		return errors.New("Token not found")
+	}
+
+	return nil
+}
+
+func (db *DB) ValidateApiToken(token string) (ApiToken, bool) {
+	query := "SELECT api_tokens.id, api_tokens.user_id, api_tokens.name, api_tokens.scopes, " +
+		"api_tokens.chat_ids, api_tokens.create_ts " +
+		"FROM api_tokens INNER JOIN users ON users.id = api_tokens.user_id " +
+		"WHERE api_tokens.hash = ? AND NOT users.deleted AND NOT users.banned"
+	var (
+		apiToken ApiToken
+		scopes   string
+		chatIds  string
+	)
+	err := db.Conn.QueryRow(query, hashAccessKey(token)).Scan(&apiToken.Id, &apiToken.UserId, &apiToken.Name,
+		&scopes, &chatIds, &apiToken.CreateTs)
+	if err != nil {
+		return apiToken, false
+	}
+	apiToken.Scopes = splitScopes(scopes)
+	apiToken.ChatIds = splitInts(chatIds)
+
+	apiToken.LastUsedTs = int(time.Now().Unix())
+	query = "UPDATE api_tokens SET last_used_ts = ? WHERE id = ?"
+	_, err = db.Conn.Exec(query, apiToken.LastUsedTs, apiToken.Id)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return apiToken, true
+}
+
+func (db *DB) BlockUser(blockerId, blockedId int) error {
+	if blockerId == blockedId {
+		return errors.New("Can't block yourself")
+	}
+
+	query := "SELECT id FROM users WHERE id = ? AND NOT deleted"
+	err := db.Conn.QueryRow(query, blockedId).Scan(&blockedId)
+	if err != nil {
+		return errors.New("User not found")
+	}
+
+	query = "INSERT IGNORE INTO blocks " +
+		"(`blocker_id`, `blocked_id`, `create_ts`) " +
+		"VALUES (?, ?, ?)"
+	_, err = db.Conn.Exec(query, blockerId, blockedId, time.Now().Unix())
+
+	return err
+}
+
+func (db *DB) UnblockUser(blockerId, blockedId int) error {
+	query := "DELETE FROM blocks WHERE blocker_id = ? AND blocked_id = ? LIMIT 1"
+	_, err := db.Conn.Exec(query, blockerId, blockedId)
+
+	return err
+}
+
+func (db *DB) GetBlockedUsers(blockerId int) ([]User, error) {
+	query := "SELECT users.id, IF(users.deleted, '" + DeletedUsername + "', users.username), users.register_ts, " +
+		"users.display_name, users.bio, users.avatar_hash, users.last_seen_ts, users.is_bot " +
+		"FROM blocks INNER JOIN users ON users.id = blocks.blocked_id " +
+		"WHERE blocks.blocker_id = ? " +
+		"ORDER BY blocks.create_ts DESC"
+	rows, err := db.Conn.Query(query, blockerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		err = rows.Scan(&user.Id, &user.Username, &user.RegisterTs, &user.DisplayName, &user.Bio, &user.AvatarHash, &user.LastSeenTs, &user.IsBot)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+func (db *DB) IsBlocked(blockerId, blockedId int) bool {
+	query := "SELECT blocker_id FROM blocks WHERE blocker_id = ? AND blocked_id = ?"
+	err := db.Conn.QueryRow(query, blockerId, blockedId).Scan(&blockerId)
+
+	return err == nil
+}
+
+/* Returns ids of users who blocked the user */
+func (db *DB) GetBlockerIds(userId int) (map[int]bool, error) {
+	query := "SELECT blocker_id FROM blocks WHERE blocked_id = ?"
+	rows, err := db.Conn.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blockerIds := make(map[int]bool)
+	for rows.Next() {
+		var blockerId int
+		err = rows.Scan(&blockerId)
+		if err != nil {
+			return nil, err
+		}
+		blockerIds[blockerId] = true
+	}
+
+	return blockerIds, nil
+}
+
+func (db *DB) SetLastSeen(userId, lastSeenTs int) error {
+	query := "UPDATE users SET last_seen_ts = ? WHERE id = ?"
+	_, err := db.Conn.Exec(query, lastSeenTs, userId)
+
+	return err
+}
+
+func (db *DB) UpdateProfile(userId int, displayName, bio string) error {
+	query := "UPDATE users SET display_name = ?, bio = ? WHERE id = ?"
+	_, err := db.Conn.Exec(query, displayName, bio, userId)
+
+	return err
+}
+
+/* Returns hash of the replaced avatar, so its file can be removed */
+func (db *DB) SetAvatar(userId int, hash string) (string, error) {
+	query := "SELECT avatar_hash FROM users WHERE id = ?"
+	var oldHash string
+	err := db.Conn.QueryRow(query, userId).Scan(&oldHash)
+	if err != nil {
+		return "", err
+	}
+
+	query = "UPDATE users SET avatar_hash = ? WHERE id = ?"
+	_, err = db.Conn.Exec(query, hash, userId)
+	if err != nil {
+		return "", err
+	}
+
+	return oldHash, nil
+}
+
+type AccessKey struct {
+	Key            string `json:"accessKey"`
+	DeathTs        int    `json:"deathTs"`
+	RefreshToken   string `json:"refreshToken"`
+	RefreshDeathTs int    `json:"refreshDeathTs"`
+}
+
+func newAccessKey() (*AccessKey, error) {
+	key, err := generateAccessKey()
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := generateAccessKey()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	accessKey := &AccessKey{
+		Key:            key,
+		DeathTs:        int(now.Add(AccessKeyLifetime).Unix()),
+		RefreshToken:   refreshToken,
+		RefreshDeathTs: int(now.Add(SessionLifetime).Unix()),
+	}
+
+	return accessKey, nil
+}
+
+/* Returns a challenge instead of the access key
+ * if the user has to confirm login with a TOTP code
+ */
+func (db *DB) CreateAccessKey(username, password, userAgent, ip string) (*AccessKey, string, error) {
+	query := "SELECT id, register_ts, hash, hash_algo, totp_enabled, banned " +
+		"FROM users WHERE username = ?"
+	queryResult := db.Conn.QueryRow(query, username)
+
+	var (
+		userId      int
+		registerTs  int
+		hash        string
+		hashAlgo    string
+		totpEnabled bool
+		banned      bool
+	)
+
+	err := queryResult.Scan(&userId, &registerTs, &hash, &hashAlgo, &totpEnabled, &banned)
+	if err != nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, "", ErrInvalidCredentials
+	}
+
+	passwordMatches, needsRehash := checkPassword(hashAlgo, hash, username, registerTs, password)
+	if !passwordMatches {
+		return nil, "", ErrInvalidCredentials
+	}
+
+	/* Only told after the right password, so bans aren't revealed to strangers */
+	if banned {
+		return nil, "", ErrUserBanned
+	}
+
+	if needsRehash {
+		err = db.setPasswordHash(userId, password)
+		if err != nil {
+			log.Println("Can't upgrade password hash", err)
+		}
+	}
+
+	if totpEnabled {
+		challenge, err := db.createAuthChallenge(userId)
+		return nil, challenge, err
+	}
+
+	accessKey, err := db.createSession(userId, userAgent, ip)
+	return accessKey, "", err
+}
+
+func (db *DB) createSession(userId int, userAgent, ip string) (*AccessKey, error) {
+	query := "INSERT INTO access_keys " +
+		"(`hash`, `user_id`, `death_ts`, `create_ts`, `user_agent`, `ip`, `refresh_hash`, `refresh_death_ts`) " +
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+
+	accessKey, err := newAccessKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(userAgent) > 256 {
+		userAgent = userAgent[:256]
+	}
+
+	_, err = db.Conn.Exec(query, hashAccessKey(accessKey.Key), userId, accessKey.DeathTs, time.Now().Unix(),
+		userAgent, ip, hashAccessKey(accessKey.RefreshToken), accessKey.RefreshDeathTs)
+	if err != nil {
+		return nil, err
+	}
+
+	/* First login ever */
+	query = "UPDATE users SET auth_done = TRUE WHERE id = ? AND NOT auth_done"
+	result, err := db.Conn.Exec(query, userId)
+	if err == nil {
+		if updatedCount, _ := result.RowsAffected(); updatedCount > 0 {
+			addChatMember(db.Conn, 1, userId, false)
+		}
+	}
+
+	return accessKey, nil
+}
+
+func (db *DB) createAuthChallenge(userId int) (string, error) {
+	challenge, err := generateAccessKey()
+	if err != nil {
+		return "", err
+	}
+
+	query := "INSERT INTO auth_challenges " +
+		"(`hash`, `user_id`, `death_ts`) " +
+		"VALUES (?, ?, ?)"
+	deathTs := time.Now().Add(time.Minute * 5).Unix()
+	_, err = db.Conn.Exec(query, hashAccessKey(challenge), userId, deathTs)
+	if err != nil {
+		return "", err
+	}
+
+	return challenge, nil
+}
+
+/* Finishes login started by CreateAccessKey.
+ * A challenge is dropped after a few wrong codes, so they can't be brute-forced.
+ * Also returns the username the challenge was issued for, when it is still valid,
+ * so that wrong codes and the login itself are counted against the account.
+ */
+func (db *DB) CompleteAuthChallenge(challenge, code, userAgent, ip string) (*AccessKey, string, error) {
+	challengeHash := hashAccessKey(challenge)
+
+	query := "SELECT auth_challenges.user_id, auth_challenges.failed_attempts, users.username " +
+		"FROM auth_challenges INNER JOIN users ON users.id = auth_challenges.user_id " +
+		"WHERE auth_challenges.hash = ? AND auth_challenges.death_ts > ?"
+	var (
+		userId, failedAttempts int
+		username               string
+	)
+	err := db.Conn.QueryRow(query, challengeHash, time.Now().Unix()).Scan(&userId, &failedAttempts, &username)
+	if err != nil || failedAttempts >= 5 {
+		return nil, "", ErrInvalidChallenge
+	}
+
+	if !db.checkSecondFactor(userId, code) {
+		query = "UPDATE auth_challenges SET failed_attempts = failed_attempts + 1 WHERE hash = ?"
+		db.Conn.Exec(query, challengeHash)
+		return nil, username, ErrInvalidCode
+	}
+
+	query = "DELETE FROM auth_challenges WHERE hash = ? LIMIT 1"
+	result, err := db.Conn.Exec(query, challengeHash)
+	if err != nil {
+		return nil, username, err
+	}
+
+	/* Completed concurrently with the same challenge */
+	deletedCount, err := result.RowsAffected()
+	if err != nil {
+		return nil, username, err
+	}
+	if deletedCount == 0 {
+		return nil, username, ErrInvalidChallenge
+	}
+
+	accessKey, err := db.createSession(userId, userAgent, ip)
+	return accessKey, username, err
+}
+
+/* Accepts either a TOTP code or one of unused backup codes */
+func (db *DB) checkSecondFactor(userId int, code string) bool {
+	query := "SELECT totp_secret, totp_last_step FROM users " +
+		"WHERE id = ? AND totp_enabled"
+	var (
+		secret   string
+		lastStep int64
+	)
+	err := db.Conn.QueryRow(query, userId).Scan(&secret, &lastStep)
+	if err != nil {
+		return false
+	}
+
+	if step, valid := checkTotpCode(secret, code, lastStep); valid {
+		query = "UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?"
+		result, err := db.Conn.Exec(query, step, userId, step)
+		if err != nil {
+			return false
+		}
+		updatedCount, err := result.RowsAffected()
+		return err == nil && updatedCount > 0
+	}
+
+	query = "DELETE FROM totp_backup_codes WHERE user_id = ? AND hash = ? LIMIT 1"
+	result, err := db.Conn.Exec(query, userId, hashAccessKey(strings.ToLower(code)))
+	if err != nil {
+		return false
+	}
+	deletedCount, err := result.RowsAffected()
+
+	return err == nil && deletedCount > 0
+}
+
+/* Generates a new secret, which is enabled only after ConfirmTotp,
+ * returns the secret and otpauth URI for QR codes
+ */
+func (db *DB) SetupTotp(userId int) (string, string, error) {
+	query := "SELECT username, totp_enabled FROM users WHERE id = ?"
+	var (
+		username    string
+		totpEnabled bool
+	)
+	err := db.Conn.QueryRow(query, userId).Scan(&username, &totpEnabled)
+	if err != nil {
+		return "", "", errors.New("User does not exist")
+	}
+	if totpEnabled {
+		return "", "", errors.New("TOTP already enabled")
+	}
+
+	key := make([]byte, 20)
+	_, err = rand.Read(key)
+	if err != nil {
+		return "", "", err
+	}
+	secret := totpEncoding.EncodeToString(key)
+
+	query = "UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?"
+	_, err = db.Conn.Exec(query, secret, userId)
+	if err != nil {
+		return "", "", err
+	}
+
+	uriParams := url.Values{}
+	uriParams.Set("secret", secret)
+	uriParams.Set("issuer", TotpIssuer)
+	uriParams.Set("algorithm", "SHA1")
+	uriParams.Set("digits", strconv.Itoa(totpDigits))
+	uriParams.Set("period", strconv.Itoa(totpPeriod))
+	uri := "otpauth://totp/" + url.PathEscape(TotpIssuer+":"+username) + "?" + uriParams.Encode()
+
+	return secret, uri, nil
+}
+
+/* Enables TOTP once the user proved the authenticator works,
+ * returns one-time backup codes
+ */
+func (db *DB) ConfirmTotp(userId int, code string) ([]string, error) {
+	query := "SELECT totp_secret, totp_enabled FROM users WHERE id = ?"
+	var (
+		secret      string
+		totpEnabled bool
+	)
+	err := db.Conn.QueryRow(query, userId).Scan(&secret, &totpEnabled)
+	if err != nil {
+		return nil, errors.New("User does not exist")
+	}
+	if totpEnabled {
+		return nil, errors.New("TOTP already enabled")
+	}
+	if secret == "" {
+		return nil, errors.New("TOTP is not set up")
+	}
+
+	step, valid := checkTotpCode(secret, code, 0)
+	if !valid {
+		return nil, ErrInvalidCode
+	}
+
+	query = "DELETE FROM totp_backup_codes WHERE user_id = ?"
+	_, err = db.Conn.Exec(query, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	backupCodes := make([]string, backupCodesCount)
+	for i := range backupCodes {
+		codeBytes := make([]byte, 5)
+		_, err = rand.Read(codeBytes)
+		if err != nil {
+			return nil, err
+		}
+		backupCodes[i] = hex.EncodeToString(codeBytes)
+
+		query = "INSERT INTO totp_backup_codes (`user_id`, `hash`) VALUES (?, ?)"
+		_, err = db.Conn.Exec(query, userId, hashAccessKey(backupCodes[i]))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query = "UPDATE users SET totp_enabled = TRUE, totp_last_step = ? WHERE id = ?"
+	_, err = db.Conn.Exec(query, step, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return backupCodes, nil
+}
+
+/* Needs both the password and a current code, so a stolen password alone can't strip 2FA */
+func (db *DB) DisableTotp(userId int, password, code string) error {
+	err := db.CheckUserPassword(userId, password)
+	if err != nil {
+		return err
+	}
+
+	if !db.checkSecondFactor(userId, code) {
+		return ErrInvalidCode
+	}
+
+	query := "DELETE FROM totp_backup_codes WHERE user_id = ?"
+	_, err = db.Conn.Exec(query, userId)
+	if err != nil {
+		return err
+	}
+
+	query = "UPDATE users SET totp_secret = '', totp_enabled = FALSE, totp_last_step = 0 WHERE id = ?"
+	_, err = db.Conn.Exec(query, userId)
+
+	return err
+}
+
+/* Issued by an administrator to a user who forgot the password.
+ * A new code replaces the previous one.
+ */
+func (db *DB) CreatePasswordResetCode(username string) (string, int, error) {
+	query := "SELECT id FROM users WHERE username = ? AND NOT deleted"
+	var userId int
+	err := db.Conn.QueryRow(query, username).Scan(&userId)
+	if err != nil {
+		return "", 0, errors.New("User does not exist")
+	}
+
+	codeBytes := make([]byte, 8)
+	_, err = rand.Read(codeBytes)
+	if err != nil {
+		return "", 0, err
+	}
+	code := hex.EncodeToString(codeBytes)
+
+	query = "DELETE FROM password_reset_codes WHERE user_id = ?"
+	_, err = db.Conn.Exec(query, userId)
+	if err != nil {
+		return "", 0, err
+	}
+
+	query = "INSERT INTO password_reset_codes " +
+		"(`hash`, `user_id`, `death_ts`) " +
+		"VALUES (?, ?, ?)"
+	deathTs := int(time.Now().Add(time.Hour).Unix())
+	_, err = db.Conn.Exec(query, hashAccessKey(code), userId, deathTs)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return code, deathTs, nil
+}
+
+/* Sets a new password and logs the user out everywhere,
+ * returns id of the user the code was issued for
+ */
+func (db *DB) ResetPassword(code, newPassword string) (int, error) {
+	codeHash := hashAccessKey(strings.ToLower(code))
+
+	query := "SELECT user_id FROM password_reset_codes WHERE hash = ? AND death_ts > ?"
+	var userId int
+	err := db.Conn.QueryRow(query, codeHash, time.Now().Unix()).Scan(&userId)
+	if err != nil {
+		return 0, ErrInvalidCode
+	}
+
+	query = "DELETE FROM password_reset_codes WHERE hash = ? LIMIT 1"
+	result, err := db.Conn.Exec(query, codeHash)
+	if err != nil {
+		return 0, err
+	}
+
+	/* Used concurrently */
+	deletedCount, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if deletedCount == 0 {
+		return 0, ErrInvalidCode
+	}
+
+	err = db.setPasswordHash(userId, newPassword)
+	if err != nil {
+		return 0, err
+	}
+
+	query = "DELETE FROM access_keys WHERE user_id = ?"
+	_, err = db.Conn.Exec(query, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	return userId, nil
+}
+
+func (db *DB) CheckUserPassword(userId int, password string) error {
+	query := "SELECT username, register_ts, hash, hash_algo " +
+		"FROM users WHERE id = ? AND NOT deleted"
+	var (
+		username   string
+		registerTs int
+		hash       string
+		hashAlgo   string
+	)
+	err := db.Conn.QueryRow(query, userId).Scan(&username, &registerTs, &hash, &hashAlgo)
+	if err != nil {
+		return errors.New("User does not exist")
+	}
+
+	passwordMatches, _ := checkPassword(hashAlgo, hash, username, registerTs, password)
+	if !passwordMatches {
+		return errors.New("Incorrect password")
+	}
+
+	return nil
+}
+
+func (db *DB) ChangePassword(userId int, oldPassword, newPassword string) error {
+	err := db.CheckUserPassword(userId, oldPassword)
+	if err != nil {
+		return err
+	}
+
+	return db.setPasswordHash(userId, newPassword)
+}
+
+/* Frees the username and removes credentials,
+ * the row itself stays for messages.sender_id
+ */
+func (db *DB) DeleteUser(userId int) error {
+	queries := []string{
+		"DELETE FROM access_keys WHERE user_id = ?",
+		"DELETE FROM auth_challenges WHERE user_id = ?",
+		"DELETE FROM totp_backup_codes WHERE user_id = ?",
+		"DELETE FROM password_reset_codes WHERE user_id = ?",
+		"DELETE FROM blocks WHERE blocker_id = ?",
+		"DELETE FROM blocks WHERE blocked_id = ?",
+		"DELETE FROM bot_updates WHERE bot_id = ?",
+		"DELETE FROM api_tokens WHERE user_id = ?",
+		"DELETE FROM chat_bans WHERE user_id = ?",
+		"UPDATE bots SET token_hash = NULL, webhook_url = '' WHERE user_id = ?",
+	}
+	for _, query := range queries {
+		_, err := db.Conn.Exec(query, userId)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := "UPDATE users " +
+		"SET username = NULL, hash = NULL, deleted = TRUE, display_name = '', bio = '', avatar_hash = '', " +
+		"totp_secret = '', totp_enabled = FALSE " +
+		"WHERE id = ?"
+	_, err := db.Conn.Exec(query, userId)
+
+	return err
+}
+
+func (db *DB) IsAdmin(userId int) bool {
+	query := "SELECT is_admin FROM users WHERE id = ? AND NOT deleted AND NOT banned"
+	var isAdmin bool
+	err := db.Conn.QueryRow(query, userId).Scan(&isAdmin)
+	if err != nil {
+		return false
+	}
+
+	return isAdmin
+}
+
+func (db *DB) SetAdmin(username string, isAdmin bool) error {
+	query := "SELECT id FROM users WHERE username = ? AND NOT is_bot"
+	var userId int
+	err := db.Conn.QueryRow(query, username).Scan(&userId)
+	if err != nil {
+		return errors.New("User not found")
+	}
+
+	query = "UPDATE users SET is_admin = ? WHERE id = ?"
+	_, err = db.Conn.Exec(query, isAdmin, userId)
+
+	return err
+}
+
+/* Banned users keep their data but can't log in,
+ * their sessions end at once while bot tokens just stop working until unban
+ */
+func (db *DB) BanUser(userId int) error {
+	query := "UPDATE users SET banned = TRUE WHERE id = ? AND NOT deleted"
+	result, err := db.Conn.Exec(query, userId)
+	if err != nil {
+		return err
+	}
+	if updatedCount, _ := result.RowsAffected(); updatedCount == 0 {
+		return errors.New("User not found or already banned")
+	}
+
+	queries := []string{
+		"DELETE FROM access_keys WHERE user_id = ?",
+		"DELETE FROM auth_challenges WHERE user_id = ?",
+		"DELETE FROM password_reset_codes WHERE user_id = ?",
+	}
+	for _, query := range queries {
+		_, err = db.Conn.Exec(query, userId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *DB) UnbanUser(userId int) error {
+	query := "UPDATE users SET banned = FALSE WHERE id = ? AND banned"
+	result, err := db.Conn.Exec(query, userId)
+	if err != nil {
+		return err
+	}
+	if updatedCount, _ := result.RowsAffected(); updatedCount == 0 {
+		return errors.New("User not found or not banned")
+	}
+
+	return nil
+}
+
+/* User as seen in the admin API */
+type AdminUser struct {
+	User
+	IsAdmin  bool `json:"isAdmin"`
+	IsBanned bool `json:"isBanned"`
+	Deleted  bool `json:"deleted"`
+}
+
+/* Lists all users including deleted and banned ones,
+ * filtered by username or display name if the query isn't empty
+ */
+func (db *DB) AdminSearchUsers(searchQuery string, offset, count int) ([]AdminUser, error) {
+	substring := "%" + likeEscaper.Replace(strings.ToLower(searchQuery)) + "%"
+
+	query := "SELECT id, IFNULL(username, '" + DeletedUsername + "'), register_ts, display_name, bio, avatar_hash, " +
+		"last_seen_ts, is_bot, is_admin, banned, deleted " +
+		"FROM users " +
+		"WHERE ? = '' OR username_lower LIKE ? OR display_name_lower LIKE ? " +
+		"ORDER BY id " +
+		"LIMIT ? OFFSET ?"
+	rows, err := db.Conn.Query(query, searchQuery, substring, substring, count, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []AdminUser{}
+	for rows.Next() {
+		var user AdminUser
+		err = rows.Scan(&user.Id, &user.Username, &user.RegisterTs, &user.DisplayName, &user.Bio, &user.AvatarHash,
+			&user.LastSeenTs, &user.IsBot, &user.IsAdmin, &user.IsBanned, &user.Deleted)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+func (db *DB) setPasswordHash(userId int, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	query := "UPDATE users SET hash = ?, hash_algo = ? WHERE id = ?"
+	_, err = db.Conn.Exec(query, hash, HashAlgoBcrypt, userId)
+
+	return err
+}
+
+func generateAccessKey() (string, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(key), nil
+}
+
+/* Only hashes of access keys are stored,
+ * so leaked access_keys rows can't be used to log in
+ */
+func hashAccessKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func (db *DB) ValidateAccessKey(key string) (keyExists bool, userId int) {
+	query := "SELECT user_id, death_ts, hash " +
+		"FROM access_keys WHERE hash = ? AND death_ts > ?"
+	queryResult := db.Conn.QueryRow(query, hashAccessKey(key), time.Now().Unix())
+
+	var keyData struct {
+		UserId  int
+		DeathTs int
+		Hash    string
+	}
+
+	err := queryResult.Scan(&keyData.UserId, &keyData.DeathTs, &keyData.Hash)
+	if err != nil {
+		return false, 0
+	}
+
+	return true, keyData.UserId
+}
+
+/* Rotates both the access key and the refresh token of the session.
+ * Presenting an already rotated refresh token revokes the whole session,
+ * since either the client or an attacker holds a stolen copy.
+ */
+func (db *DB) RefreshAccessKey(refreshToken string) (*AccessKey, error) {
+	refreshHash := hashAccessKey(refreshToken)
+	now := time.Now().Unix()
+
+	query := "SELECT id FROM access_keys " +
+		"WHERE refresh_hash = ? AND refresh_death_ts > ?"
+	var sessionId int
+	err := db.Conn.QueryRow(query, refreshHash, now).Scan(&sessionId)
+	if err != nil {
+		query = "SELECT session_id FROM used_refresh_tokens WHERE hash = ?"
+		err = db.Conn.QueryRow(query, refreshHash).Scan(&sessionId)
+		if err != nil {
+			return nil, errors.New("Invalid refresh token")
+		}
+
+		log.Println("Refresh token reuse detected, revoking session", sessionId)
+		query = "DELETE FROM access_keys WHERE id = ? LIMIT 1"
+		_, err = db.Conn.Exec(query, sessionId)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New("Invalid refresh token")
+	}
+
+	accessKey, err := newAccessKey()
+	if err != nil {
+		return nil, err
+	}
+
+	query = "UPDATE access_keys " +
+		"SET hash = ?, death_ts = ?, refresh_hash = ?, refresh_death_ts = ? " +
+		"WHERE id = ? AND refresh_hash = ?"
+	result, err := db.Conn.Exec(query, hashAccessKey(accessKey.Key), accessKey.DeathTs,
+		hashAccessKey(accessKey.RefreshToken), accessKey.RefreshDeathTs, sessionId, refreshHash)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Someone else rotated this token between SELECT and UPDATE */
+	updatedCount, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if updatedCount == 0 {
+		return nil, errors.New("Invalid refresh token")
+	}
+
+	query = "INSERT INTO used_refresh_tokens " +
+		"(`hash`, `session_id`, `death_ts`) " +
+		"VALUES (?, ?, ?)"
+	_, err = db.Conn.Exec(query, refreshHash, sessionId, accessKey.RefreshDeathTs)
+	if err != nil {
+		return nil, err
+	}
+
+	return accessKey, nil
+}
+
+func (db *DB) DeleteAccessKey(key string) error {
+	query := "DELETE FROM access_keys WHERE hash = ? LIMIT 1"
+	_, err := db.Conn.Exec(query, hashAccessKey(key))
+
+	return err
+}
+
+func (db *DB) GetSessionId(key string) (int, bool) {
+	query := "SELECT id FROM access_keys WHERE hash = ?"
+	var sessionId int
+	err := db.Conn.QueryRow(query, hashAccessKey(key)).Scan(&sessionId)
+	if err != nil {
+		return 0, false
+	}
+
+	return sessionId, true
+}
+
+func (db *DB) SessionExists(sessionId int) bool {
+	query := "SELECT id FROM access_keys WHERE id = ? AND refresh_death_ts > ?"
+	err := db.Conn.QueryRow(query, sessionId, time.Now().Unix()).Scan(&sessionId)
+
+	return err == nil
+}
+
+type Session struct {
+	Id        int    `json:"id"`
+	CreateTs  int    `json:"createTs"`
+	DeathTs   int    `json:"deathTs"`
+	UserAgent string `json:"userAgent"`
+	Ip        string `json:"ip"`
+	Current   bool   `json:"current"`
+}
+
+/* Returns active sessions of the user,
+ * the one authorized with currentKey is marked as current
+ */
+func (db *DB) GetSessions(userId int, currentKey string) ([]Session, error) {
+	query := "SELECT id, hash, IFNULL(create_ts, 0), refresh_death_ts, IFNULL(user_agent, ''), IFNULL(ip, '') " +
+		"FROM access_keys " +
+		"WHERE user_id = ? AND refresh_death_ts > ? " +
+		"ORDER BY id DESC"
+	rows, err := db.Conn.Query(query, userId, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	currentHash := hashAccessKey(currentKey)
+	sessions := []Session{}
+	for rows.Next() {
+		var (
+			session Session
+			hash    string
+		)
+		err = rows.Scan(&session.Id, &hash, &session.CreateTs, &session.DeathTs, &session.UserAgent, &session.Ip)
+		if err != nil {
+			return nil, err
+		}
+		session.Current = hash == currentHash
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+func (db *DB) RevokeSession(userId, sessionId int) error {
+	query := "DELETE FROM access_keys WHERE id = ? AND user_id = ? LIMIT 1"
+	result, err := db.Conn.Exec(query, sessionId, userId)
+	if err != nil {
+		return err
+	}
+
+	deletedCount, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deletedCount == 0 {
+		return errors.New("Session not found")
+	}
+
+	return nil
+}
+
+func (db *DB) RevokeOtherSessions(userId int, currentKey string) error {
+	query := "DELETE FROM access_keys WHERE user_id = ? AND hash != ?"
+	_, err := db.Conn.Exec(query, userId, hashAccessKey(currentKey))
+
+	return err
+}
+
+func (db *DB) DeleteExpiredAccessKeys() (int, error) {
+	now := time.Now().Unix()
+
+	query := "DELETE FROM access_keys WHERE refresh_death_ts <= ?"
+	result, err := db.Conn.Exec(query, now)
+	if err != nil {
+		return 0, err
+	}
+
+	deletedCount, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	query = "DELETE FROM used_refresh_tokens WHERE death_ts <= ?"
+	_, err = db.Conn.Exec(query, now)
+	if err != nil {
+		return int(deletedCount), err
+	}
+
+	query = "DELETE FROM auth_challenges WHERE death_ts <= ?"
+	_, err = db.Conn.Exec(query, now)
+	if err != nil {
+		return int(deletedCount), err
+	}
+
+	query = "DELETE FROM password_reset_codes WHERE death_ts <= ?"
+	_, err = db.Conn.Exec(query, now)
+	if err != nil {
+		return int(deletedCount), err
+	}
+
+	/* Bots which never came for their updates */
+	query = "DELETE FROM bot_updates WHERE create_ts <= ?"
+	_, err = db.Conn.Exec(query, now-int64(BotUpdatesLifetime.Seconds()))
+	if err != nil {
+		return int(deletedCount), err
+	}
+
+	return int(deletedCount), nil
+}
+
+func (db *DB) CreateChat(ownerId int, name string, password string) (int, error) {
+	query := "INSERT INTO chats " +
+		"(`owner_id`, `name`, `create_ts`, `hash`, `last_message_ts`, `messages_count`, `members_count`) " +
+		"VALUES (?, ?, ?, ?, ?, 0, 0)"
+
+	ts := int(time.Now().Unix())
+	hash := sha256.Sum256([]byte(name + strconv.Itoa(ts) + password))
+	hashString := hex.EncodeToString(hash[:])
+
+	result, err := db.Conn.Exec(query, ownerId, name, ts, hashString, ts)
+	if err != nil {
+		return 0, err
+	}
+
+	chatId, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	err = addChatMember(db.Conn, int(chatId), ownerId, true)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(chatId), nil
+}
+
+func (db *DB) EnterChat(userId int, chatName, ChatPassword string) (int, error) {
+	query := "SELECT id, create_ts, hash, IFNULL(hash_name, name) FROM chats WHERE name = ?"
+	chat := db.Conn.QueryRow(query, chatName)
+	var (
+		chatId       int
+		chatCreateTs int
+		chatHash     string
+		chatHashName string
+	)
+	err := chat.Scan(&chatId, &chatCreateTs, &chatHash, &chatHashName)
+	if err != nil {
+		log.Println(err)
+		return 0, ErrInvalidChatCredentials
+	}
+
+	hashOfGivenPassword := sha256.Sum256([]byte(chatHashName + strconv.Itoa(chatCreateTs) + ChatPassword))
+	hashOfGivenPasswordString := hex.EncodeToString(hashOfGivenPassword[:])
+
+	if hashOfGivenPasswordString != chatHash {
+		return 0, ErrInvalidChatCredentials
+	}
+
+	if db.IsBannedFromChat(chatId, userId) {
+		return 0, ErrBannedFromChat
+	}
+
+	userAlreadyInChat := db.IsUserInChat(userId, chatId)
+	if err != nil {
+		return 0, nil
+	}
+	if userAlreadyInChat {
+		return 0, errors.New("User already in chat")
+	}
+
+	err = addChatMember(db.Conn, chatId, userId, false)
+	if err != nil {
+		return 0, err
+	}
+
+	return chatId, nil
+}
+
+type ChatInvite struct {
+	Id        int  `json:"id"`
+	ChatId    int  `json:"chatId"`
+	CreatorId int  `json:"creatorId"`
+	CreateTs  int  `json:"createTs"`
+	DeathTs   int  `json:"deathTs"`
+	MaxUses   int  `json:"maxUses"`
+	Uses      int  `json:"uses"`
+	Revoked   bool `json:"revoked"`
+}
+
+/* Zero deathTs and maxUses mean no limit,
+ * returns the invite token, only its hash is stored
+ */
+func (db *DB) CreateInvite(chatId, creatorId, deathTs, maxUses int) (string, ChatInvite, error) {
+	tokenBytes := make([]byte, 16)
+	_, err := rand.Read(tokenBytes)
+	if err != nil {
+		return "", ChatInvite{}, err
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	invite := ChatInvite{
+		ChatId:    chatId,
+		CreatorId: creatorId,
+		CreateTs:  int(time.Now().Unix()),
+		DeathTs:   deathTs,
+		MaxUses:   maxUses,
+	}
+
+	query := "INSERT INTO chat_invites " +
+		"(`chat_id`, `creator_id`, `hash`, `create_ts`, `death_ts`, `max_uses`) " +
+		"VALUES (?, ?, ?, ?, ?, ?)"
+	result, err := db.Conn.Exec(query, chatId, creatorId, hashAccessKey(token), invite.CreateTs, deathTs, maxUses)
+	if err != nil {
+		return "", ChatInvite{}, err
+	}
+
+	inviteId, err := result.LastInsertId()
+	if err != nil {
+		return "", ChatInvite{}, err
+	}
+	invite.Id = int(inviteId)
+
+	return token, invite, nil
+}
+
+func (db *DB) GetChatInvites(chatId int) ([]ChatInvite, error) {
+	query := "SELECT id, chat_id, creator_id, create_ts, death_ts, max_uses, uses, revoked " +
+		"FROM chat_invites WHERE chat_id = ? ORDER BY id DESC"
+	rows, err := db.Conn.Query(query, chatId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []ChatInvite{}
+	for rows.Next() {
+		var invite ChatInvite
+		err = rows.Scan(&invite.Id, &invite.ChatId, &invite.CreatorId, &invite.CreateTs, &invite.DeathTs,
+			&invite.MaxUses, &invite.Uses, &invite.Revoked)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+
+	return invites, nil
+}
+
+func (db *DB) RevokeInvite(chatId, inviteId int) error {
+	query := "UPDATE chat_invites SET revoked = TRUE WHERE id = ? AND chat_id = ? AND NOT revoked"
+	result, err := db.Conn.Exec(query, inviteId, chatId)
+	if err != nil {
+		return err
+	}
+	if updatedCount, _ := result.RowsAffected(); updatedCount == 0 {
+		return errors.New("Invite not found")
+	}
+
+	return nil
+}
+
+/* Adds the user to the invite's chat, returns the chat id */
+func (db *DB) JoinByInvite(userId int, token string) (int, error) {
+	query := "SELECT id, chat_id, creator_id FROM chat_invites WHERE hash = ?"
+	var inviteId, chatId, creatorId int
+	err := db.Conn.QueryRow(query, hashAccessKey(strings.ToLower(token))).Scan(&inviteId, &chatId, &creatorId)
+	if err != nil {
+		return 0, ErrInvalidInvite
+	}
+
+	if db.IsUserInChat(userId, chatId) {
+		return 0, errors.New("User already in chat")
+	}
+
+	if db.IsBannedFromChat(chatId, userId) {
+		return 0, ErrBannedFromChat
+	}
+
+	/* Looks the same as a broken invite to users blocked by its creator */
+	if db.IsBlocked(creatorId, userId) {
+		return 0, ErrInvalidInvite
+	}
+
+	/* A use is counted only together with the membership */
+	transaction, err := db.Conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer transaction.Rollback()
+
+	/* Checked and counted at once, so concurrent joins can't exceed max_uses */
+	query = "UPDATE chat_invites SET uses = uses + 1 " +
+		"WHERE id = ? AND NOT revoked AND (max_uses = 0 OR uses < max_uses) AND (death_ts = 0 OR death_ts > ?)"
+	result, err := transaction.Exec(query, inviteId, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	if updatedCount, _ := result.RowsAffected(); updatedCount == 0 {
+		return 0, ErrInvalidInvite
+	}
+
+	err = addChatMember(transaction, chatId, userId, false)
+	if err != nil {
+		/* Joined concurrently with the same or another invite */
+		if db.IsUserInChat(userId, chatId) {
+			return 0, errors.New("User already in chat")
+		}
+		return 0, err
+	}
+
+	return chatId, transaction.Commit()
+}
+
+/* Nil arguments are left as they are.
+ * The password hash is salted with the chat name, so a chat renamed
+ * without a new password keeps the old name in hash_name.
+ */
+func (db *DB) UpdateChat(chatId int, name, password, description *string) error {
+	query := "SELECT name, create_ts FROM chats WHERE id = ? AND name IS NOT NULL"
+	var (
+		currentName string
+		createTs    int
+	)
+	err := db.Conn.QueryRow(query, chatId).Scan(&currentName, &createTs)
+	if err != nil {
+		return errors.New("Chat not found")
+	}
+
+	if name != nil && *name != currentName {
+		query = "UPDATE chats SET hash_name = IFNULL(hash_name, name), name = ? WHERE id = ?"
+		_, err = db.Conn.Exec(query, *name, chatId)
+		if err != nil {
+			return errors.New("Chat name already taken")
+		}
+		currentName = *name
+	}
+
+	if password != nil {
+		hash := sha256.Sum256([]byte(currentName + strconv.Itoa(createTs) + *password))
+		query = "UPDATE chats SET hash = ?, hash_name = NULL WHERE id = ?"
+		_, err = db.Conn.Exec(query, hex.EncodeToString(hash[:]), chatId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if description != nil {
+		query = "UPDATE chats SET description = ? WHERE id = ?"
+		_, err = db.Conn.Exec(query, *description, chatId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addChatMember(conn sqlExecutor, chatId, userId int, isOwner bool) error {
+	role := RoleMember
+	if isOwner {
+		role = RoleOwner
+	}
+
+	query := "INSERT INTO chats_members " +
+		"(`chat_id`, `member_id`, `role`, `join_ts`) " +
+		"VALUES (?, ?, ?, ?)"
+	_, err := conn.Exec(query, chatId, userId, role, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	query = "UPDATE chats " +
+		"SET members_count = members_count + 1 " +
+		"WHERE id = ?"
+	_, err = conn.Exec(query, chatId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/* Chat roles from the most to the least privileged */
+const (
+	RoleOwner     = "owner"
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+var roleRanks = map[string]int{
+	RoleOwner:     4,
+	RoleAdmin:     3,
+	RoleModerator: 2,
+	RoleMember:    1,
 }
 
-func (db *DB) RegisterUser(username, password string) (int, error) {
-	query := "INSERT INTO users " +
-		"(`username`, `register_ts`, `hash`, `auth_done`) " +
-		"VALUES (?, ?, ?, FALSE)"
+/* Things members may do to the chat and to members of lower roles */
+const (
+	PermDeleteMessages = "deleteMessages"
+	PermKick           = "kick"
+	PermInvite         = "invite"
+	PermEditChat       = "editChat"
+	PermChangeRoles    = "changeRoles"
+)
 
-	registerTs := int(time.Now().Unix())
-	hash := sha256.Sum256([]byte(username + strconv.Itoa(registerTs) + password))
-	hashString := hex.EncodeToString(hash[:])
+var rolePermissions = map[string][]string{
+	RoleOwner:     {PermDeleteMessages, PermKick, PermInvite, PermEditChat, PermChangeRoles},
+	RoleAdmin:     {PermDeleteMessages, PermKick, PermInvite, PermEditChat, PermChangeRoles},
+	RoleModerator: {PermDeleteMessages, PermKick},
+	RoleMember:    {},
+}
 
-	result, err := db.Conn.Exec(query, username, registerTs, hashString)
-	if err != nil {
-		return 0, err
+func IsValidRole(role string) bool {
+	_, exists := roleRanks[role]
+	return exists
+}
+
+func RoleCan(role, permission string) bool {
+	for _, rolePermission := range rolePermissions[role] {
+		if rolePermission == permission {
+			return true
+		}
 	}
+	return false
+}
 
-	userId, err := result.LastInsertId()
+/* Non-members ("" role) are outranked by everyone */
+func RoleOutranks(role, otherRole string) bool {
+	return roleRanks[role] > roleRanks[otherRole]
+}
+
+/* Returns "" if the user isn't a member */
+func (db *DB) GetMemberRole(chatId, userId int) string {
+	query := "SELECT role FROM chats_members WHERE chat_id = ? AND member_id = ?"
+	var role string
+	err := db.Conn.QueryRow(query, chatId, userId).Scan(&role)
 	if err != nil {
-		return 0, err
+		return ""
 	}
 
-	return int(userId), nil
+	return role
 }
 
-type User struct {
-	Id         int    `json:"id"`
-	Username   string `json:"username"`
-	RegisterTs int    `json:"registerTs"`
+/* Ownership changes only through TransferChatOwnership */
+func (db *DB) SetMemberRole(chatId, userId int, role string) error {
+	if !IsValidRole(role) || role == RoleOwner {
+		return errors.New("Invalid role")
+	}
+
+	query := "UPDATE chats_members SET role = ? WHERE chat_id = ? AND member_id = ? AND role != '" + RoleOwner + "'"
+	_, err := db.Conn.Exec(query, role, chatId, userId)
+
+	return err
 }
 
-func (db *DB) GetUser(userId int) (User, bool) {
-	query := "SELECT username, register_ts " +
-		"FROM users WHERE id = ?"
-	row := db.Conn.QueryRow(query, userId)
+func (db *DB) BanFromChat(chatId, userId, bannedBy int) error {
+	query := "INSERT IGNORE INTO chat_bans " +
+		"(`chat_id`, `user_id`, `banned_by`, `create_ts`) " +
+		"VALUES (?, ?, ?, ?)"
+	_, err := db.Conn.Exec(query, chatId, userId, bannedBy, time.Now().Unix())
 
-	user := User{userId, "", 0}
-	err := row.Scan(&user.Username, &user.RegisterTs)
+	return err
+}
+
+func (db *DB) UnbanFromChat(chatId, userId int) error {
+	query := "DELETE FROM chat_bans WHERE chat_id = ? AND user_id = ?"
+	result, err := db.Conn.Exec(query, chatId, userId)
 	if err != nil {
-		log.Println(err)
-		return user, false
+		return err
+	}
+	if deletedCount, _ := result.RowsAffected(); deletedCount == 0 {
+		return errors.New("User not banned")
 	}
 
-	return user, true
+	return nil
 }
 
-func (db *DB) CreateAccessKey(username, password string) (string, int, error) {
-	query := "SELECT id, register_ts, hash, auth_done " +
-		"FROM users WHERE username = ?"
-	queryResult := db.Conn.QueryRow(query, username)
+func (db *DB) IsBannedFromChat(chatId, userId int) bool {
+	query := "SELECT user_id FROM chat_bans WHERE chat_id = ? AND user_id = ?"
+	var bannedId int
+	return db.Conn.QueryRow(query, chatId, userId).Scan(&bannedId) == nil
+}
 
-	var (
-		userId     int
-		registerTs int
-		hash       string
-		authDone   bool
-	)
+type ChatBan struct {
+	UserId   int    `json:"userId"`
+	Username string `json:"username"`
+	BannedBy int    `json:"bannedBy"`
+	CreateTs int    `json:"createTs"`
+}
 
-	err := queryResult.Scan(&userId, &registerTs, &hash, &authDone)
+func (db *DB) GetChatBans(chatId int) ([]ChatBan, error) {
+	query := "SELECT chat_bans.user_id, IF(users.deleted, '" + DeletedUsername + "', users.username), " +
+		"chat_bans.banned_by, chat_bans.create_ts " +
+		"FROM chat_bans INNER JOIN users ON users.id = chat_bans.user_id " +
+		"WHERE chat_bans.chat_id = ? ORDER BY chat_bans.create_ts DESC"
+	rows, err := db.Conn.Query(query, chatId)
 	if err != nil {
-		return "", 0, errors.New("User does not exist")
+		return nil, err
 	}
+	defer rows.Close()
 
-	hashOfGivenPassword := sha256.Sum256([]byte(username + strconv.Itoa(registerTs) + password))
-	hashOfGivenPasswordString := hex.EncodeToString(hashOfGivenPassword[:])
-
-	if hashOfGivenPasswordString != hash {
-		return "", 0, errors.New("Incorrect password")
+	bans := []ChatBan{}
+	for rows.Next() {
+		var ban ChatBan
+		err = rows.Scan(&ban.UserId, &ban.Username, &ban.BannedBy, &ban.CreateTs)
+		if err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
 	}
 
-	query = "INSERT INTO access_keys VALUES (?, ?, ?)"
+	return bans, nil
+}
 
-	deathTs := int(time.Now().Add(time.Hour * 24).Unix())
-	key := sha256.Sum256([]byte(username + strconv.Itoa(deathTs) + password))
-	keyString := hex.EncodeToString(key[:])
+func (db *DB) RemoveChatMember(userId, chatId int) error {
+	return removeChatMember(db.Conn, userId, chatId)
+}
 
-	_, err = db.Conn.Exec(query, userId, deathTs, keyString)
+func removeChatMember(conn sqlExecutor, userId, chatId int) error {
+	query := "DELETE FROM chats_members WHERE chat_id = ? AND member_id = ? LIMIT 1"
+	_, err := conn.Exec(query, chatId, userId)
 	if err != nil {
-		return "", 0, err
+		return err
 	}
 
-	if !authDone {
-		db.addChatMember(1, userId, false)
-		query = "UPDATE users SET auth_done = TRUE WHERE id = ?"
-		db.Conn.Exec(query, userId)
-	}
+	query = "UPDATE chats SET members_count = members_count - 1 WHERE id = ?"
+	_, err = conn.Exec(query, chatId)
 
-	return keyString, deathTs, nil
+	return err
 }
 
-func (db *DB) ValidateAccessKey(key string) (keyExists bool, userId int) {
-	query := "SELECT user_id, death_ts, hash " +
-		"FROM access_keys WHERE hash = ?"
-	queryResult := db.Conn.QueryRow(query, key)
-
-	var keyData struct {
-		UserId  int
-		DeathTs int
-		Hash    string
+/* Removes the member, handing the chat over to the next owner if they own it.
+ * Returns the new owner, if any, and whether the user is the last member:
+ * then nothing is removed, the user is made the owner and the chat should be deleted.
+ * Leaves of one chat are serialized by locking its row, otherwise members
+ * leaving at the same time could hand the chat over to each other and leave it empty.
+ */
+func (db *DB) LeaveChat(userId, chatId int) (int, bool, error) {
+	transaction, err := db.Conn.Begin()
+	if err != nil {
+		return 0, false, err
 	}
+	defer transaction.Rollback()
 
-	err := queryResult.Scan(&keyData.UserId, &keyData.DeathTs, &keyData.Hash)
+	query := "SELECT id FROM chats WHERE id = ? FOR UPDATE"
+	err = transaction.QueryRow(query, chatId).Scan(&chatId)
 	if err != nil {
-		return false, 0
+		return 0, false, errors.New("Chat not found")
 	}
 
-	return true, keyData.UserId
-}
-
-func (db *DB) CreateChat(ownerId int, name string, password string) (int, error) {
-	query := "INSERT INTO chats " +
-		"(`owner_id`, `name`, `create_ts`, `hash`, `last_message_ts`, `messages_count`, `members_count`) " +
-		"VALUES (?, ?, ?, ?, ?, 0, 0)"
+	var role string
+	query = "SELECT role FROM chats_members WHERE chat_id = ? AND member_id = ?"
+	err = transaction.QueryRow(query, chatId, userId).Scan(&role)
+	if err != nil {
+		return 0, false, errors.New("Chat not found")
+	}
 
-	ts := int(time.Now().Unix())
-	hash := sha256.Sum256([]byte(name + strconv.Itoa(ts) + password))
-	hashString := hex.EncodeToString(hash[:])
+	nextOwnerId := getNextChatOwner(transaction, chatId, userId)
+	if nextOwnerId == 0 {
+		/* The owner's membership keeps the chat deletable until it's gone */
+		if role != RoleOwner {
+			err = transferChatOwnership(transaction, chatId, userId)
+			if err != nil {
+				return 0, false, err
+			}
+		}
+		return 0, true, transaction.Commit()
+	}
 
-	result, err := db.Conn.Exec(query, ownerId, name, ts, hashString, ts)
-	if err != nil {
-		return 0, err
+	newOwnerId := 0
+	if role == RoleOwner {
+		err = transferChatOwnership(transaction, chatId, nextOwnerId)
+		if err != nil {
+			return 0, false, err
+		}
+		newOwnerId = nextOwnerId
 	}
 
-	chatId, err := result.LastInsertId()
+	err = removeChatMember(transaction, userId, chatId)
 	if err != nil {
-		return 0, err
+		return 0, false, err
 	}
 
-	err = db.addChatMember(int(chatId), ownerId, true)
+	return newOwnerId, false, transaction.Commit()
+}
+
+/* Returns a member who may take over the chat, 0 if there is nobody left.
+ * Admins go first, then moderators, then members, the longest-standing of them.
+ */
+func getNextChatOwner(conn sqlExecutor, chatId, exceptUserId int) int {
+	query := "SELECT member_id FROM chats_members " +
+		"WHERE chat_id = ? AND member_id != ? " +
+		"ORDER BY CASE role WHEN '" + RoleAdmin + "' THEN 0 WHEN '" + RoleModerator + "' THEN 1 ELSE 2 END, " +
+		"join_ts, member_id LIMIT 1"
+	var memberId int
+	err := conn.QueryRow(query, chatId, exceptUserId).Scan(&memberId)
 	if err != nil {
-		return 0, err
+		return 0
 	}
 
-	return int(chatId), nil
+	return memberId
 }
 
-func (db *DB) EnterChat(userId int, chatName, ChatPassword string) (int, error) {
-	query := "SELECT id, create_ts, hash FROM chats WHERE name = ?"
-	chat := db.Conn.QueryRow(query, chatName)
-	var (
-		chatId       int
-		chatCreateTs int
-		chatHash     string
-	)
-	err := chat.Scan(&chatId, &chatCreateTs, &chatHash)
+/* The previous owner, if still a member, becomes an admin.
+ * chats_members.role is authoritative, chats.owner_id is a copy for chat listings
+ * and is written only here and when the chat is created.
+ */
+func (db *DB) TransferChatOwnership(chatId, newOwnerId int) error {
+	return transferChatOwnership(db.Conn, chatId, newOwnerId)
+}
+
+func transferChatOwnership(conn sqlExecutor, chatId, newOwnerId int) error {
+	query := "UPDATE chats_members " +
+		"SET role = IF(member_id = ?, '" + RoleOwner + "', IF(role = '" + RoleOwner + "', '" + RoleAdmin + "', role)) " +
+		"WHERE chat_id = ?"
+	_, err := conn.Exec(query, newOwnerId, chatId)
 	if err != nil {
-		log.Println(err)
-		return 0, errors.New("Chat not found")
+		return err
 	}
 
-	hashOfGivenPassword := sha256.Sum256([]byte(chatName + strconv.Itoa(chatCreateTs) + ChatPassword))
-	hashOfGivenPasswordString := hex.EncodeToString(hashOfGivenPassword[:])
+	query = "UPDATE chats SET owner_id = ? WHERE id = ?"
+	_, err = conn.Exec(query, newOwnerId, chatId)
 
-	if hashOfGivenPasswordString != chatHash {
-		return 0, errors.New("Access denied")
+	return err
+}
+
+/* Messages and attachments of deleted chats are removed in batches of this size,
+ * so a large chat doesn't keep the tables locked for long
+ */
+const deleteChatBatchSize = 1000
+
+/* Removes the chat with all its messages,
+ * returns hashes of attachments whose files should be removed,
+ * also on failure, since their rows are already gone,
+ * and ids of bots the deletedPayload was queued for.
+ * The owner stays a member until the chat row itself is deleted,
+ * so a failed deletion can be retried and resumes where it stopped.
+ */
+func (db *DB) DeleteChat(chatId int, deletedPayload []byte) ([]string, []int, error) {
+	queries := []string{
+		"DELETE FROM chat_invites WHERE chat_id = ?",
+		"DELETE FROM chat_bans WHERE chat_id = ?",
+		"DELETE FROM bot_updates WHERE chat_id = ?",
+	}
+	for _, query := range queries {
+		_, err := db.Conn.Exec(query, chatId)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	userAlreadyInChat := db.IsUserInChat(userId, chatId)
+	err := db.removeChatFromApiTokens(chatId)
 	if err != nil {
-		return 0, nil
+		return nil, nil, err
 	}
-	if userAlreadyInChat {
-		return 0, errors.New("User already in chat")
+
+	/* Bots are found through memberships, so they are told before those go.
+	 * The update isn't bound to the chat and stays after it.
+	 */
+	botIds, err := db.addBotUpdates(chatId, 0, deletedPayload, nil)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	err = db.addChatMember(chatId, userId, false)
+	/* Other members go first, so nobody posts while messages are being deleted */
+	query := "DELETE FROM chats_members WHERE chat_id = ? AND role != '" + RoleOwner + "'"
+	_, err = db.Conn.Exec(query, chatId)
 	if err != nil {
-		return 0, err
+		return nil, botIds, err
 	}
 
-	return chatId, nil
-}
+	attachmentHashes := []string{}
+	for {
+		query := "SELECT hash FROM messages_attachments WHERE chat_id = ? " +
+			"ORDER BY message_id, hash LIMIT ?"
+		rows, err := db.Conn.Query(query, chatId, deleteChatBatchSize)
+		if err != nil {
+			return attachmentHashes, botIds, err
+		}
+
+		batchHashes := []string{}
+		for rows.Next() {
+			var hash string
+			err = rows.Scan(&hash)
+			if err != nil {
+				rows.Close()
+				return attachmentHashes, botIds, err
+			}
+			batchHashes = append(batchHashes, hash)
+		}
+		rows.Close()
+
+		if len(batchHashes) == 0 {
+			break
+		}
+
+		/* Same order and limit, so exactly the selected rows */
+		query = "DELETE FROM messages_attachments WHERE chat_id = ? " +
+			"ORDER BY message_id, hash LIMIT ?"
+		_, err = db.Conn.Exec(query, chatId, len(batchHashes))
+		if err != nil {
+			return attachmentHashes, botIds, err
+		}
+		attachmentHashes = append(attachmentHashes, batchHashes...)
+	}
+
+	for {
+		query := "DELETE FROM messages WHERE chat_id = ? LIMIT ?"
+		result, err := db.Conn.Exec(query, chatId, deleteChatBatchSize)
+		if err != nil {
+			return attachmentHashes, botIds, err
+		}
+		if deletedCount, _ := result.RowsAffected(); deletedCount < deleteChatBatchSize {
+			break
+		}
+	}
 
-func (db *DB) addChatMember(chatId, userId int, isOwner bool) error {
-	query := "INSERT INTO chats_members VALUES " +
-		"(?, ?, ?)"
-	_, err := db.Conn.Exec(query, chatId, userId, isOwner)
+	/* The owner's membership and the chat disappear together */
+	transaction, err := db.Conn.Begin()
 	if err != nil {
-		return err
+		return attachmentHashes, botIds, err
 	}
+	defer transaction.Rollback()
 
-	query = "UPDATE chats " +
-		"SET members_count = members_count + 1 " +
-		"WHERE id = ?"
-	_, err = db.Conn.Exec(query, chatId)
+	query = "DELETE FROM chats_members WHERE chat_id = ?"
+	_, err = transaction.Exec(query, chatId)
 	if err != nil {
-		return err
+		return attachmentHashes, botIds, err
 	}
 
-	return nil
+	query = "DELETE FROM chats WHERE id = ?"
+	_, err = transaction.Exec(query, chatId)
+	if err != nil {
+		return attachmentHashes, botIds, err
+	}
+
+	return attachmentHashes, botIds, transaction.Commit()
 }
 
-func (db *DB) RemoveChatMember(userId, chatId int) error {
-	query := "DELETE FROM chats_members WHERE chat_id = ? AND member_id = ? LIMIT 1"
-	_, err := db.Conn.Exec(query, chatId, userId)
+/* Tokens limited to the chat lose it, tokens left with no chats are deleted
+ * since empty chat_ids would open all chats to them
+ */
+func (db *DB) removeChatFromApiTokens(chatId int) error {
+	query := "SELECT id, chat_ids FROM api_tokens WHERE FIND_IN_SET(?, chat_ids)"
+	rows, err := db.Conn.Query(query, chatId)
 	if err != nil {
 		return err
 	}
 
-	query = "UPDATE chats SET members_count = members_count - 1 WHERE id = ?"
-	_, err = db.Conn.Exec(query, chatId)
+	chatIdsByToken := make(map[int][]int)
+	for rows.Next() {
+		var tokenId int
+		var chatIds string
+		err = rows.Scan(&tokenId, &chatIds)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		chatIdsByToken[tokenId] = splitInts(chatIds)
+	}
+	rows.Close()
 
-	return err
+	for tokenId, chatIds := range chatIdsByToken {
+		remainingChatIds := []int{}
+		for _, id := range chatIds {
+			if id != chatId {
+				remainingChatIds = append(remainingChatIds, id)
+			}
+		}
+
+		if len(remainingChatIds) == 0 {
+			_, err = db.Conn.Exec("DELETE FROM api_tokens WHERE id = ?", tokenId)
+		} else {
+			_, err = db.Conn.Exec("UPDATE api_tokens SET chat_ids = ? WHERE id = ?", joinInts(remainingChatIds), tokenId)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (db *DB) AddMessage(chatId, senderId int, text string) (int, error) {
@@ -354,6 +2884,10 @@ func (db *DB) AddMessage(chatId, senderId int, text string) (int, error) {
 		return 0, errors.New("Max message length is 2048")
 	}
 
+	if peerId := db.GetDirectChatPeer(chatId, senderId); peerId != 0 && db.IsBlocked(peerId, senderId) {
+		return 0, errors.New("You can't message this user")
+	}
+
 	query := "INSERT INTO messages " +
 		"(`chat_id`, `sender_id`, `ts`, `text`) " +
 		"VALUES (?, ?, ?, ?)"
@@ -414,15 +2948,27 @@ type Chat struct {
 	Id            int    `json:"id"`
 	Name          string `json:"name"`
 	LastMessageTs int    `json:"lastMessageTs"`
+	IsDirect      bool   `json:"isDirect"`
+	PeerId        int    `json:"peerId,omitempty"`
 }
 
+/* Columns with the other user of a direct chat and the chat's title,
+ * which for direct chats is that user's name. Both take the viewer's id.
+ */
+const (
+	chatPeerIdColumn = "IFNULL(IF(chats.dm_user1_id = ?, chats.dm_user2_id, chats.dm_user1_id), 0)"
+	chatTitleColumn  = "IFNULL(chats.name, (SELECT IF(users.deleted, '" + DeletedUsername + "', " +
+		"IF(users.display_name != '', users.display_name, users.username)) " +
+		"FROM users WHERE users.id = IF(chats.dm_user1_id = ?, chats.dm_user2_id, chats.dm_user1_id)))"
+)
+
 func (db *DB) GetUserChats(userId int) ([]Chat, error) {
-	query := "SELECT chats.id, chats.name, chats.last_message_ts " +
+	query := "SELECT chats.id, " + chatTitleColumn + ", chats.last_message_ts, " + chatPeerIdColumn + " " +
 		"FROM chats_members LEFT JOIN chats " +
 		"ON chats_members.chat_id = chats.id " +
 		"WHERE chats_members.member_id = ? " +
 		"ORDER BY chats.last_message_ts DESC"
-	rows, err := db.Conn.Query(query, userId)
+	rows, err := db.Conn.Query(query, userId, userId, userId)
 	if err != nil {
 		return nil, err
 	}
@@ -432,13 +2978,189 @@ func (db *DB) GetUserChats(userId int) ([]Chat, error) {
 
 	for rows.Next() {
 		var chatData Chat
-		rows.Scan(&chatData.Id, &chatData.Name, &chatData.LastMessageTs)
+		rows.Scan(&chatData.Id, &chatData.Name, &chatData.LastMessageTs, &chatData.PeerId)
+		chatData.IsDirect = chatData.PeerId != 0
 		chats = append(chats, chatData)
 	}
 
 	return chats, nil
 }
 
+/* Returns the existing direct chat of the pair or creates one,
+ * the bool tells if the peer has just got the chat in their list
+ */
+func (db *DB) StartDirectChat(userId, peerId int) (int, bool, error) {
+	if userId == peerId {
+		return 0, false, errors.New("Can't start a chat with yourself")
+	}
+
+	query := "SELECT deleted, banned FROM users WHERE id = ?"
+	var peerDeleted, peerBanned bool
+	err := db.Conn.QueryRow(query, peerId).Scan(&peerDeleted, &peerBanned)
+	if err != nil || peerDeleted || peerBanned {
+		return 0, false, errors.New("User not found")
+	}
+
+	if db.IsBlocked(peerId, userId) {
+		return 0, false, errors.New("You can't message this user")
+	}
+
+	user1Id, user2Id := userId, peerId
+	if user1Id > user2Id {
+		user1Id, user2Id = user2Id, user1Id
+	}
+
+	chatId := db.getDirectChat(user1Id, user2Id)
+	if chatId == 0 {
+		query = "INSERT INTO chats " +
+			"(`create_ts`, `last_message_ts`, `messages_count`, `members_count`, `dm_user1_id`, `dm_user2_id`) " +
+			"VALUES (?, ?, 0, 0, ?, ?)"
+		ts := time.Now().Unix()
+		result, err := db.Conn.Exec(query, ts, ts, user1Id, user2Id)
+		if err == nil {
+			insertedId, _ := result.LastInsertId()
+			chatId = int(insertedId)
+		} else {
+			/* Started by the other user at the same time */
+			chatId = db.getDirectChat(user1Id, user2Id)
+			if chatId == 0 {
+				return 0, false, err
+			}
+		}
+	}
+
+	/* New chats have no members, old ones may have been left */
+	peerAdded := false
+	for _, memberId := range []int{userId, peerId} {
+		if !db.IsUserInChat(memberId, chatId) {
+			err = addChatMember(db.Conn, chatId, memberId, false)
+			if err != nil {
+				return 0, false, err
+			}
+			peerAdded = peerAdded || memberId == peerId
+		}
+	}
+
+	return chatId, peerAdded, nil
+}
+
+func (db *DB) getDirectChat(user1Id, user2Id int) int {
+	query := "SELECT id FROM chats WHERE dm_user1_id = ? AND dm_user2_id = ?"
+	var chatId int
+	err := db.Conn.QueryRow(query, user1Id, user2Id).Scan(&chatId)
+	if err != nil {
+		return 0
+	}
+
+	return chatId
+}
+
+/* Returns the other user of a direct chat, 0 for ordinary chats */
+func (db *DB) GetDirectChatPeer(chatId, userId int) int {
+	query := "SELECT " + chatPeerIdColumn + " FROM chats WHERE id = ?"
+	var peerId int
+	err := db.Conn.QueryRow(query, userId, chatId).Scan(&peerId)
+	if err != nil {
+		return 0
+	}
+
+	return peerId
+}
+
+func (db *DB) ChatExists(chatId int) bool {
+	query := "SELECT id FROM chats WHERE id = ?"
+	var id int
+	return db.Conn.QueryRow(query, chatId).Scan(&id) == nil
+}
+
+/* Chat as seen in the admin API */
+type ChatSummary struct {
+	Id            int    `json:"id"`
+	OwnerId       int    `json:"ownerId"`
+	Name          string `json:"name"`
+	CreateTs      int    `json:"createTs"`
+	LastMessageTs int    `json:"lastMessageTs"`
+	MembersCount  int    `json:"membersCount"`
+	MessagesCount int    `json:"messagesCount"`
+}
+
+/* Lists all chats, filtered by name if the query isn't empty */
+func (db *DB) AdminSearchChats(searchQuery string, offset, count int) ([]ChatSummary, error) {
+	substring := "%" + likeEscaper.Replace(strings.ToLower(searchQuery)) + "%"
+
+	query := "SELECT id, IFNULL(owner_id, 0), IFNULL(name, ''), create_ts, last_message_ts, members_count, messages_count " +
+		"FROM chats " +
+		"WHERE ? = '' OR LOWER(name) LIKE ? " +
+		"ORDER BY id " +
+		"LIMIT ? OFFSET ?"
+	rows, err := db.Conn.Query(query, searchQuery, substring, count, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chats := []ChatSummary{}
+	for rows.Next() {
+		var chat ChatSummary
+		err = rows.Scan(&chat.Id, &chat.OwnerId, &chat.Name, &chat.CreateTs, &chat.LastMessageTs,
+			&chat.MembersCount, &chat.MessagesCount)
+		if err != nil {
+			return nil, err
+		}
+		chats = append(chats, chat)
+	}
+
+	return chats, nil
+}
+
+type ServerStats struct {
+	Users          int `json:"users"`
+	BannedUsers    int `json:"bannedUsers"`
+	DeletedUsers   int `json:"deletedUsers"`
+	Bots           int `json:"bots"`
+	Chats          int `json:"chats"`
+	Messages       int `json:"messages"`
+	Attachments    int `json:"attachments"`
+	ActiveSessions int `json:"activeSessions"`
+	OnlineUsers    int `json:"onlineUsers"`
+}
+
+/* Everything but OnlineUsers, which only the server process knows */
+func (db *DB) GetServerStats() (ServerStats, error) {
+	var stats ServerStats
+
+	query := "SELECT " +
+		"IFNULL(SUM(NOT deleted AND NOT is_bot), 0), " +
+		"IFNULL(SUM(banned AND NOT deleted), 0), " +
+		"IFNULL(SUM(deleted), 0), " +
+		"IFNULL(SUM(is_bot AND NOT deleted), 0) " +
+		"FROM users"
+	err := db.Conn.QueryRow(query).Scan(&stats.Users, &stats.BannedUsers, &stats.DeletedUsers, &stats.Bots)
+	if err != nil {
+		return stats, err
+	}
+
+	counts := []struct {
+		Query string
+		Dest  *int
+	}{
+		{"SELECT COUNT(*) FROM chats", &stats.Chats},
+		{"SELECT COUNT(*) FROM messages", &stats.Messages},
+		{"SELECT COUNT(*) FROM messages_attachments", &stats.Attachments},
+	}
+	for _, count := range counts {
+		err = db.Conn.QueryRow(count.Query).Scan(count.Dest)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	query = "SELECT COUNT(*) FROM access_keys WHERE refresh_death_ts > ?"
+	err = db.Conn.QueryRow(query, time.Now().Unix()).Scan(&stats.ActiveSessions)
+
+	return stats, err
+}
+
 type Attachment struct {
 	ContentType string `json:"contentType"`
 	Hash        string `json:"hash"`
@@ -455,18 +3177,24 @@ type Message struct {
 }
 
 type ChatMember struct {
-	Id       int    `json:"id"`
-	Username string `json:"username"`
+	Id         int    `json:"id"`
+	Username   string `json:"username"`
+	Role       string `json:"role"`
+	Status     string `json:"status"`
+	LastSeenTs int    `json:"lastSeenTs"`
 }
 
 type ChatInformation struct {
 	Id            int    `json:"id"`
 	OwnerId       int    `json:"ownerId"`
 	Name          string `json:"name"`
+	Description   string `json:"description"`
 	CreateTs      int    `json:"createTs"`
 	LastMessageTs int    `json:"lastMessageTs"`
 	MembersCount  int    `json:"membersCount"`
 	MessagesCount int    `json:"messagesCount"`
+	IsDirect      bool   `json:"isDirect"`
+	PeerId        int    `json:"peerId,omitempty"`
 	Messages      struct {
 		Offset int       `json:"offset"`
 		Count  int       `json:"count"`
@@ -488,19 +3216,22 @@ func (db *DB) GetChat(userId, chatId int, withLastMessages, withMembers bool) (*
 		return nil, errors.New("Access denied")
 	}
 
-	query = "SELECT id, owner_id, name, create_ts, last_message_ts, messages_count, members_count " +
+	query = "SELECT id, IFNULL(owner_id, 0), " + chatTitleColumn + ", description, create_ts, last_message_ts, messages_count, members_count, " +
+		chatPeerIdColumn + " " +
 		"FROM chats WHERE id = ?"
-	row = db.Conn.QueryRow(query, chatId)
+	row = db.Conn.QueryRow(query, userId, userId, chatId)
 
 	var chat ChatInformation
-	err := row.Scan(&chat.Id, &chat.OwnerId, &chat.Name, &chat.CreateTs, &chat.LastMessageTs, &chat.MessagesCount, &chat.MembersCount)
+	err := row.Scan(&chat.Id, &chat.OwnerId, &chat.Name, &chat.Description, &chat.CreateTs, &chat.LastMessageTs, &chat.MessagesCount, &chat.MembersCount,
+		&chat.PeerId)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
+	chat.IsDirect = chat.PeerId != 0
 
 	if withLastMessages {
-		messages, err := db.GetMessages(chatId, 0, 20, true)
+		messages, err := db.GetMessages(userId, chatId, 0, 20, true)
 		if err != nil {
 			return nil, err
 		}
@@ -521,27 +3252,31 @@ func (db *DB) GetChat(userId, chatId int, withLastMessages, withMembers bool) (*
 }
 
 func (db *DB) GetChatMembers(chatId int) ([]ChatMember, error) {
-	query := "SELECT id, username FROM users " +
-		"WHERE id IN (SELECT member_id FROM chats_members WHERE chat_id = ?)"
+	query := "SELECT users.id, users.username, chats_members.role, users.last_seen_ts " +
+		"FROM chats_members INNER JOIN users ON users.id = chats_members.member_id " +
+		"WHERE chats_members.chat_id = ?"
 	rows, err := db.Conn.Query(query, chatId)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	var members []ChatMember
 	for rows.Next() {
 		var cm ChatMember
-		rows.Scan(&cm.Id, &cm.Username)
+		rows.Scan(&cm.Id, &cm.Username, &cm.Role, &cm.LastSeenTs)
 		members = append(members, cm)
 	}
 
 	return members, nil
 }
 
-func (db *DB) GetMessages(chatId, offset, messagesCount int, withUsernames bool) ([]Message, error) {
+/* Messages from users blocked by the viewer are skipped */
+func (db *DB) GetMessages(viewerId, chatId, offset, messagesCount int, withUsernames bool) ([]Message, error) {
 	var query string
 	if withUsernames {
-		query = "SELECT messages.chat_id, messages.message_id, messages.sender_id, messages.ts, messages.text, users.username, " +
+		query = "SELECT messages.chat_id, messages.message_id, messages.sender_id, messages.ts, messages.text, " +
+			"IF(users.deleted, '" + DeletedUsername + "', users.username), " +
 			"attachments.type, attachments.hash " +
 			"FROM messages " +
 			"LEFT JOIN messages_attachments AS attachments " +
@@ -549,6 +3284,7 @@ func (db *DB) GetMessages(chatId, offset, messagesCount int, withUsernames bool)
 			"LEFT JOIN users " +
 			"ON users.id = messages.sender_id " +
 			"WHERE messages.chat_id = ? " +
+			"AND messages.sender_id NOT IN (SELECT blocked_id FROM blocks WHERE blocker_id = ?) " +
 			"ORDER BY messages.message_id DESC " +
 			"LIMIT ? OFFSET ?"
 	} else {
@@ -558,11 +3294,12 @@ func (db *DB) GetMessages(chatId, offset, messagesCount int, withUsernames bool)
 			"LEFT JOIN messages_attachments AS attachments " +
 			"ON messages.chat_id = attachments.chat_id AND messages.message_id = attachments.message_id " +
 			"WHERE messages.chat_id = ? " +
+			"AND messages.sender_id NOT IN (SELECT blocked_id FROM blocks WHERE blocker_id = ?) " +
 			"ORDER BY messages.message_id DESC " +
 			"LIMIT ? OFFSET ?"
 	}
 
-	rows, err := db.Conn.Query(query, chatId, messagesCount, offset)
+	rows, err := db.Conn.Query(query, chatId, viewerId, messagesCount, offset)
 	if err != nil {
 		return nil, err
 	}
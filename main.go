@@ -1,22 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"./database"
 
@@ -115,8 +124,9 @@ func handleAuth(response http.ResponseWriter, request *http.Request) {
 
 	decoder := json.NewDecoder(request.Body)
 	var data struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+		Username  string `json:"username"`
+		Password  string `json:"password"`
+		UseCookie bool   `json:"useCookie"`
 	}
 	err := decoder.Decode(&data)
 	if err != nil {
@@ -124,6 +134,13 @@ func handleAuth(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	ipKey := "ip:" + getRemoteIp(request)
+	accountKey := "user:" + data.Username
+	if retryAfter := authAttempts.RetryAfter(ipKey, accountKey); retryAfter > 0 {
+		writeTooManyAttempts(response, retryAfter)
+		return
+	}
+
 	db, err := openSqlConnection()
 	if err != nil {
 		io.WriteString(response, `{"error":"Internal server error"}`)
@@ -131,104 +148,78 @@ func handleAuth(response http.ResponseWriter, request *http.Request) {
 	}
 	defer db.Close()
 
-	accessKey, deathTs, err := db.CreateAccessKey(data.Username, data.Password)
+	accessKey, challenge, err := db.CreateAccessKey(data.Username, data.Password, request.UserAgent(), getRemoteIp(request))
+	if err == database.ErrInvalidCredentials {
+		authAttempts.Fail(ipKey, accountKey)
+	} else if err == nil && challenge == "" {
+		/* With 2FA the account is cleared only by /authTotp */
+		authAttempts.Reset(accountKey)
+	}
 	if err != nil {
 		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
 		return
 	}
 
-	cookie := &http.Cookie{
-		Name:    "authorized",
-		Value:   strconv.Itoa(deathTs),
-		Expires: time.Now().Add(time.Hour * 24),
-	}
-	http.SetCookie(response, cookie)
-	io.WriteString(response, fmt.Sprintf(`{"accessKey":"%s","deathTs":%d}`, accessKey, deathTs))
-}
-
-func checkAccessKey(response http.ResponseWriter, request *http.Request) (database.DB, bool, int) {
-	accessKey := request.Header.Get("Authorization")
-
-	db, err := openSqlConnection()
-	if err != nil {
-		io.WriteString(response, `{"error":"Server internal error"}`)
-		return db, false, 0
-	}
-
-	authorized, userId := db.ValidateAccessKey(accessKey)
-
-	if !authorized {
-		cookie := &http.Cookie{
-			Name:    "authorized",
-			Expires: time.Unix(0, 0),
-		}
-		http.SetCookie(response, cookie)
-		io.WriteString(response, `{"error":"Invalid access key","errorCode":1}`)
-		db.Close()
+	if challenge != "" {
+		io.WriteString(response, fmt.Sprintf(`{"totpRequired":true,"challenge":"%s"}`, challenge))
+		return
 	}
 
-	return db, authorized, userId
+	writeAccessKey(response, request, accessKey, data.UseCookie)
 }
 
-func handleGetMe(response http.ResponseWriter, request *http.Request) {
-	if request.Method != "GET" {
+func handleAuthTotp(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
 		io.WriteString(response, `{"error":"Wrong method"}`)
 		return
 	}
 
-	db, authorized, userId := checkAccessKey(response, request)
-	if !authorized {
-		return
+	decoder := json.NewDecoder(request.Body)
+	var data struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+		UseCookie bool   `json:"useCookie"`
 	}
-	defer db.Close()
-
-	/* I know this "exists" may be useless,
-	 * but what if user asynchronously deleted after checking accessKey?
-	 */
-	user, exists := db.GetUser(userId)
-	if !exists {
-		io.WriteString(response, `{"error":"User not found"}`)
+	err := decoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
 		return
 	}
 
-	io.WriteString(response, fmt.Sprintf(`{"user":{"id":%d,"username":"%s","registerTs":%d}}`, user.Id, user.Username, user.RegisterTs))
-}
-
-func handleGetUser(response http.ResponseWriter, request *http.Request) {
-	if request.Method != "GET" {
-		io.WriteString(response, `{"error":"Wrong method"}`)
+	ipKey := "ip:" + getRemoteIp(request)
+	if retryAfter := authAttempts.RetryAfter(ipKey); retryAfter > 0 {
+		writeTooManyAttempts(response, retryAfter)
 		return
 	}
 
-	db, authorized, _ := checkAccessKey(response, request)
-	if !authorized {
+	db, err := openSqlConnection()
+	if err != nil {
+		io.WriteString(response, `{"error":"Internal server error"}`)
 		return
 	}
 	defer db.Close()
 
-	userIdString := request.URL.Query().Get("id")
-	if userIdString == "" {
-		io.WriteString(response, `{"error":"No parameter \"id\" specified"}`)
-		return
+	code := strings.ReplaceAll(strings.TrimSpace(data.Code), " ", "")
+	accessKey, username, err := db.CompleteAuthChallenge(data.Challenge, code, request.UserAgent(), getRemoteIp(request))
+	accountKey := "user:" + username
+	if err == database.ErrInvalidCode {
+		/* Each challenge allows only a few codes, but new ones come with the password */
+		authAttempts.Fail(ipKey, accountKey)
+	} else if err == database.ErrInvalidChallenge {
+		authAttempts.Fail(ipKey)
+	} else if err == nil {
+		authAttempts.Reset(accountKey)
 	}
-
-	userId, err := strconv.Atoi(userIdString)
 	if err != nil {
-		io.WriteString(response, `{"error":"Invalid parameter \"id\" specified"}`)
-		return
-	}
-
-	user, exists := db.GetUser(userId)
-	if !exists {
-		io.WriteString(response, `{"error":"User not found"}`)
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
 		return
 	}
 
-	io.WriteString(response, fmt.Sprintf(`{"user":{"id":%d,"username":"%s","registerTs":%d}}`, user.Id, user.Username, user.RegisterTs))
+	writeAccessKey(response, request, accessKey, data.UseCookie)
 }
 
-func handleGetChats(response http.ResponseWriter, request *http.Request) {
-	if request.Method != "GET" {
+func handleSetupTotp(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
 		io.WriteString(response, `{"error":"Wrong method"}`)
 		return
 	}
@@ -237,23 +228,25 @@ func handleGetChats(response http.ResponseWriter, request *http.Request) {
 	if !authorized {
 		return
 	}
+	defer db.Close()
 
-	chats, err := db.GetUserChats(userId)
+	secret, uri, err := db.SetupTotp(userId)
 	if err != nil {
-		io.WriteString(response, `{"error":"Server interval error"}`)
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
 	}
 
-	var result struct {
-		Chats []database.Chat `json:"chats"`
-	}
-	result.Chats = chats
+	responseStruct := struct {
+		Secret string `json:"secret"`
+		Uri    string `json:"uri"`
+	}{secret, uri}
 
 	jsonEncoder := json.NewEncoder(response)
-	jsonEncoder.Encode(result)
+	jsonEncoder.Encode(responseStruct)
 }
 
-func handleGetChat(response http.ResponseWriter, request *http.Request) {
-	if request.Method != "GET" {
+func handleConfirmTotp(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
 		io.WriteString(response, `{"error":"Wrong method"}`)
 		return
 	}
@@ -264,28 +257,31 @@ func handleGetChat(response http.ResponseWriter, request *http.Request) {
 	}
 	defer db.Close()
 
-	chatId, err := strconv.Atoi(request.URL.Query().Get("id"))
+	var data struct {
+		Code string `json:"code"`
+	}
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&data)
 	if err != nil {
-		io.WriteString(response, `{"error":"Incorrect chatId"}`)
+		io.WriteString(response, `{"error":"Can't parse json"}`)
 		return
 	}
 
-	var responseStruct struct {
-		Chat database.ChatInformation `json:"chat"`
-	}
-	chat, err := db.GetChat(userId, chatId, true, true)
+	backupCodes, err := db.ConfirmTotp(userId, strings.TrimSpace(data.Code))
 	if err != nil {
-		log.Println(err)
-		io.WriteString(response, `{"error":"Access denied"}`)
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
 		return
 	}
-	responseStruct.Chat = *chat
+
+	responseStruct := struct {
+		BackupCodes []string `json:"backupCodes"`
+	}{backupCodes}
 
 	jsonEncoder := json.NewEncoder(response)
 	jsonEncoder.Encode(responseStruct)
 }
 
-func handleSendMessage(response http.ResponseWriter, request *http.Request) {
+func handleDisableTotp(response http.ResponseWriter, request *http.Request) {
 	if request.Method != "POST" {
 		io.WriteString(response, `{"error":"Wrong method"}`)
 		return
@@ -296,245 +292,452 @@ func handleSendMessage(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 	defer db.Close()
-	attachmentsWaitGroup := sync.WaitGroup{}
 
-	var params struct {
-		ChatId      *int      `json:"chatId"`
-		Text        *string   `json:"text"`
-		Attachments *[]string `json:"attachments"`
+	var data struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
 	}
 	decoder := json.NewDecoder(request.Body)
-	err := decoder.Decode(&params)
+	err := decoder.Decode(&data)
 	if err != nil {
-		io.WriteString(response, `{"error":"Invalid request body"}`)
-		return
-	}
-
-	if params.ChatId == nil || params.Text == nil {
-		io.WriteString(response, `{"error":"Incorrect params"}`)
-		return
-	}
-
-	*params.Text = strings.TrimSpace(*params.Text)
-	if *params.Text == "" || len(*params.Text) > 2048 {
-		io.WriteString(response, `{"error":"Incorrect text param"}`)
+		io.WriteString(response, `{"error":"Can't parse json"}`)
 		return
 	}
 
-	messageId, err := db.AddMessage(*params.ChatId, userId, *params.Text)
+	code := strings.ReplaceAll(strings.TrimSpace(data.Code), " ", "")
+	err = db.DisableTotp(userId, data.Password, code)
 	if err != nil {
 		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
 		return
 	}
 
-	io.WriteString(response, fmt.Sprintf(`{"messageId":%d}`, messageId))
-
-	type Attachment struct {
-		ContentType string `json:"contentType"`
-		Hash        string `json:"hash"`
-	}
-	var attachments []Attachment
-	if params.Attachments != nil {
-		attachmentsCount := len(*params.Attachments)
-		if attachmentsCount > 0 {
-			attachments = make([]Attachment, attachmentsCount)
-			for i, base64attachment := range *params.Attachments {
-				binaryAttachment, err := base64.StdEncoding.DecodeString(base64attachment)
-				if err != nil {
-					log.Println("Error parsing base64", err.Error())
-					continue
-				}
+	io.WriteString(response, `{"success":true}`)
+}
 
-				bytesToDetectContentType := 512
-				attachmentBinaryLength := len(binaryAttachment)
-				if attachmentBinaryLength < 512 {
-					bytesToDetectContentType = attachmentBinaryLength
-				}
-				attachmentContentType := http.DetectContentType(binaryAttachment[:bytesToDetectContentType])
+/* Counts failed password guesses per key (IP, username, chat name).
+ * After FreeAttempts failures every next one blocks the key for twice as long,
+ * up to MaxBlock.
+ */
+type attemptsLimiter struct {
+	FreeAttempts int
+	MaxBlock     time.Duration
+	Mutex        sync.Mutex
+	Attempts     map[string]*failedAttempts
+}
 
-				stringToEncode := fmt.Sprintf("chat%dmessage%dIAmLuman%d", params.ChatId, messageId, i)
-				hash := sha256.Sum256([]byte(stringToEncode))
-				hashString := hex.EncodeToString(hash[:])
+type failedAttempts struct {
+	Count        int
+	LastFailure  time.Time
+	BlockedUntil time.Time
+}
 
-				attachmentsWaitGroup.Add(2)
-				go func() {
-					filePath := fmt.Sprintf("attachments/%s", hashString)
-					ioutil.WriteFile(filePath, binaryAttachment, 0755)
-					attachmentsWaitGroup.Done()
-				}()
+/* Failures older than this are forgotten */
+const attemptsMemory = time.Hour
 
-				go func() {
-					db.AddAttachment(*params.ChatId, messageId, attachmentContentType, hashString)
-					attachmentsWaitGroup.Done()
-				}()
+var (
+	authAttempts = &attemptsLimiter{
+		FreeAttempts: 5,
+		MaxBlock:     time.Minute * 15,
+		Attempts:     make(map[string]*failedAttempts),
+	}
+	enterChatAttempts = &attemptsLimiter{
+		FreeAttempts: 5,
+		MaxBlock:     time.Minute * 15,
+		Attempts:     make(map[string]*failedAttempts),
+	}
+)
 
-				attachment := Attachment{
-					ContentType: attachmentContentType,
-					Hash:        hashString,
-				}
+func (al *attemptsLimiter) RetryAfter(keys ...string) time.Duration {
+	al.Mutex.Lock()
+	defer al.Mutex.Unlock()
 
-				attachments[i] = attachment
+	var retryAfter time.Duration
+	for _, key := range keys {
+		if attempts, exists := al.Attempts[key]; exists {
+			if blockLeft := time.Until(attempts.BlockedUntil); blockLeft > retryAfter {
+				retryAfter = blockLeft
 			}
 		}
 	}
 
-	if eventBus, exists := eventBus.Chats[*params.ChatId]; exists {
-		eventBus.Mutex.Lock()
+	return retryAfter
+}
 
-		var message struct {
-			Event     string `json:"event"`
-			EventData struct {
-				ChatId      int           `json:"chatId"`
-				MessageId   int           `json:"messageId"`
-				SenderId    int           `json:"senderId"`
-				Text        string        `json:"text"`
-				Ts          int           `json:"ts"`
-				Attachments *[]Attachment `json:"attachments,omitempty"`
-			} `json:"eventData"`
-		}
-		message.Event = "newMessage"
-		message.EventData.ChatId = *params.ChatId
-		message.EventData.MessageId = messageId
-		message.EventData.SenderId = userId
-		message.EventData.Text = *params.Text
-		message.EventData.Ts = int(time.Now().Unix())
-		if len(attachments) > 0 {
-			message.EventData.Attachments = &attachments
+func (al *attemptsLimiter) Fail(keys ...string) {
+	al.Mutex.Lock()
+	defer al.Mutex.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		attempts, exists := al.Attempts[key]
+		if !exists || now.Sub(attempts.LastFailure) > attemptsMemory {
+			attempts = new(failedAttempts)
+			al.Attempts[key] = attempts
 		}
-		jsonMessage, err := json.Marshal(message)
-		if err != nil {
-			log.Println(err)
-			return
+		attempts.Count++
+		attempts.LastFailure = now
+
+		if attempts.Count > al.FreeAttempts {
+			block := al.MaxBlock
+			if shift := attempts.Count - al.FreeAttempts - 1; shift < 16 {
+				block = time.Second << uint(shift)
+			}
+			if block > al.MaxBlock {
+				block = al.MaxBlock
+			}
+			attempts.BlockedUntil = now.Add(block)
 		}
+	}
+}
 
-		wg := sync.WaitGroup{}
-		for _, subscriber := range eventBus.Sockets {
-			wg.Add(1)
-			go func(subscriber *ws.Conn) {
-				subscriber.WriteMessage(ws.TextMessage, jsonMessage)
-				wg.Done()
-			}(subscriber)
+func (al *attemptsLimiter) Reset(keys ...string) {
+	al.Mutex.Lock()
+	defer al.Mutex.Unlock()
+
+	for _, key := range keys {
+		delete(al.Attempts, key)
+	}
+}
+
+func (al *attemptsLimiter) forgetStale(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		al.Mutex.Lock()
+		now := time.Now()
+		for key, attempts := range al.Attempts {
+			if now.Sub(attempts.LastFailure) > attemptsMemory && now.After(attempts.BlockedUntil) {
+				delete(al.Attempts, key)
+			}
 		}
-		wg.Wait()
+		al.Mutex.Unlock()
+	}
+}
+
+/* Allows at most Limit requests per key within every Window */
+type rateLimiter struct {
+	Limit   int
+	Window  time.Duration
+	Mutex   sync.Mutex
+	Windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+	Start time.Time
+	Count int
+}
+
+var searchRequests = &rateLimiter{
+	Limit:   30,
+	Window:  time.Minute,
+	Windows: make(map[string]*rateWindow),
+}
 
-		eventBus.Mutex.Unlock()
+func (rl *rateLimiter) Allow(key string) (bool, time.Duration) {
+	rl.Mutex.Lock()
+	defer rl.Mutex.Unlock()
+
+	now := time.Now()
+	window, exists := rl.Windows[key]
+	if !exists || now.Sub(window.Start) >= rl.Window {
+		window = &rateWindow{Start: now}
+		rl.Windows[key] = window
 	}
 
-	attachmentsWaitGroup.Wait()
+	if window.Count >= rl.Limit {
+		return false, window.Start.Add(rl.Window).Sub(now)
+	}
+	window.Count++
+
+	return true, 0
 }
 
-func handleGetMessages(response http.ResponseWriter, request *http.Request) {
-	if request.Method != "GET" {
+func (rl *rateLimiter) forgetStale(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		rl.Mutex.Lock()
+		now := time.Now()
+		for key, window := range rl.Windows {
+			if now.Sub(window.Start) >= rl.Window {
+				delete(rl.Windows, key)
+			}
+		}
+		rl.Mutex.Unlock()
+	}
+}
+
+func writeTooManyAttempts(response http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	response.Header().Set("Retry-After", strconv.Itoa(seconds))
+	response.WriteHeader(http.StatusTooManyRequests)
+	io.WriteString(response, fmt.Sprintf(`{"error":"Too many attempts","retryAfter":%d}`, seconds))
+}
+
+func handleResetPassword(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
 		io.WriteString(response, `{"error":"Wrong method"}`)
 		return
 	}
 
-	db, authorized, userId := checkAccessKey(response, request)
-	if !authorized {
+	decoder := json.NewDecoder(request.Body)
+	var data struct {
+		Code        string `json:"code"`
+		NewPassword string `json:"newPassword"`
+	}
+	err := decoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
 		return
 	}
-	defer db.Close()
 
-	chatIdString := request.URL.Query().Get("chatId")
-	chatId, err := strconv.Atoi(chatIdString)
-	if err != nil {
-		io.WriteString(response, `{"error":"Invalid \"chatId\" parameter"}`)
+	passwordLength := len(data.NewPassword)
+	if passwordLength < 7 || passwordLength > 32 {
+		io.WriteString(response, `{"error":"Invalid password length"}`)
 		return
 	}
 
-	userInChat := db.IsUserInChat(userId, chatId)
-	if !userInChat {
-		io.WriteString(response, `{"error":"Access denied"}`)
+	ipKey := "ip:" + getRemoteIp(request)
+	if retryAfter := authAttempts.RetryAfter(ipKey); retryAfter > 0 {
+		writeTooManyAttempts(response, retryAfter)
 		return
 	}
 
-	offsetString := request.URL.Query().Get("offset")
-	offset, err := strconv.Atoi(offsetString)
+	db, err := openSqlConnection()
 	if err != nil {
-		io.WriteString(response, `{"error":"Invalid \"offset\" parameter"}`)
+		io.WriteString(response, `{"error":"Internal server error"}`)
 		return
 	}
+	defer db.Close()
 
-	messagesCountString := request.URL.Query().Get("messagesCount")
-	messagesCount := 20
-	if messagesCountString != "" {
-		messagesCount, err = strconv.Atoi(messagesCountString)
-		if err != nil {
-			io.WriteString(response, `{"error":"Invalid \"messagesCount\" parameter"}`)
+	userId, err := db.ResetPassword(strings.TrimSpace(data.Code), data.NewPassword)
+	if err == database.ErrInvalidCode {
+		authAttempts.Fail(ipKey)
+	}
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	io.WriteString(response, `{"success":true}`)
+
+	closeRevokedSessionSockets(db, userId)
+}
+
+func handleRefresh(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	decoder := json.NewDecoder(request.Body)
+	var data struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	err := decoder.Decode(&data)
+
+	/* Sessions in cookie mode send the refresh token only as a cookie */
+	refreshCookie, cookieErr := request.Cookie(refreshTokenCookie)
+	useCookie := data.RefreshToken == "" && cookieErr == nil
+	if useCookie {
+		if !checkCsrfToken(request) {
+			io.WriteString(response, `{"error":"Invalid CSRF token"}`)
 			return
 		}
+		data.RefreshToken = refreshCookie.Value
+	} else if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
 	}
 
-	withUsernamesString := request.URL.Query().Get("withUsernames")
-	withUsernames := false
-	if withUsernamesString == "true" {
-		withUsernames = true
+	db, err := openSqlConnection()
+	if err != nil {
+		io.WriteString(response, `{"error":"Internal server error"}`)
+		return
 	}
+	defer db.Close()
 
-	messages, err := db.GetMessages(chatId, offset, messagesCount, withUsernames)
+	accessKey, err := db.RefreshAccessKey(data.RefreshToken)
 	if err != nil {
-		io.WriteString(response, `{"error":"Interval Server Error"}`)
+		clearAuthCookies(response, request)
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s","errorCode":1}`, err.Error()))
 		return
 	}
 
-	var responseStruct struct {
-		Messages []database.Message `json:"messages"`
+	writeAccessKey(response, request, accessKey, useCookie)
+}
+
+/* In cookie mode the access key and the refresh token are kept
+ * in HttpOnly cookies, out of reach of scripts on the page.
+ * It's opt-in with "useCookie", the bundled web client keeps using the Authorization header.
+ */
+const (
+	accessKeyCookie    = "accessKey"
+	refreshTokenCookie = "refreshToken"
+	csrfTokenCookie    = "csrfToken"
+	csrfTokenHeader    = "X-CSRF-Token"
+)
+
+/* Set by the insecureCookies=true environment variable,
+ * for local development over plain HTTP where browsers drop Secure cookies
+ */
+var insecureCookies bool
+
+/* Cookies are Secure unless explicitly turned off, the server can't tell
+ * whether a proxy in front of it terminates TLS
+ */
+func useSecureCookies(request *http.Request) bool {
+	return !insecureCookies
+}
+
+/* The "authorized" cookie lives as long as the session,
+ * so pages don't redirect to login while the access key can still be refreshed
+ */
+func writeAccessKey(response http.ResponseWriter, request *http.Request, accessKey *database.AccessKey, useCookie bool) {
+	cookie := &http.Cookie{
+		Name:    "authorized",
+		Value:   strconv.Itoa(accessKey.RefreshDeathTs),
+		Expires: time.Unix(int64(accessKey.RefreshDeathTs), 0),
 	}
-	responseStruct.Messages = messages
+	http.SetCookie(response, cookie)
 
-	jsonString, err := json.Marshal(responseStruct)
-	if err != nil {
-		io.WriteString(response, `{"error":"Interval Server Error"}`)
+	jsonEncoder := json.NewEncoder(response)
+	if !useCookie {
+		jsonEncoder.Encode(accessKey)
 		return
 	}
 
-	response.Write(jsonString)
+	/* Kept across refreshes, so requests sent during a refresh don't fail */
+	csrfToken := ""
+	if csrfCookie, err := request.Cookie(csrfTokenCookie); err == nil {
+		csrfToken = csrfCookie.Value
+	}
+	if len(csrfToken) != 64 {
+		tokenBytes := make([]byte, 32)
+		_, err := rand.Read(tokenBytes)
+		if err != nil {
+			log.Println(err)
+			io.WriteString(response, `{"error":"Server internal error"}`)
+			return
+		}
+		csrfToken = hex.EncodeToString(tokenBytes)
+	}
+
+	cookies := []*http.Cookie{
+		{Name: accessKeyCookie, Value: accessKey.Key, Path: "/", Expires: time.Unix(int64(accessKey.DeathTs), 0), HttpOnly: true},
+		{Name: refreshTokenCookie, Value: accessKey.RefreshToken, Path: "/refresh", Expires: time.Unix(int64(accessKey.RefreshDeathTs), 0), HttpOnly: true},
+		/* Read by scripts and sent back in the X-CSRF-Token header */
+		{Name: csrfTokenCookie, Value: csrfToken, Path: "/", Expires: time.Unix(int64(accessKey.RefreshDeathTs), 0)},
+	}
+	for _, cookie := range cookies {
+		cookie.Secure = useSecureCookies(request)
+		cookie.SameSite = http.SameSiteStrictMode
+		http.SetCookie(response, cookie)
+	}
+
+	responseStruct := struct {
+		DeathTs        int    `json:"deathTs"`
+		RefreshDeathTs int    `json:"refreshDeathTs"`
+		CsrfToken      string `json:"csrfToken"`
+	}{accessKey.DeathTs, accessKey.RefreshDeathTs, csrfToken}
+	jsonEncoder.Encode(responseStruct)
 }
 
-func handleEnterChat(response http.ResponseWriter, request *http.Request) {
+func clearAuthCookies(response http.ResponseWriter, request *http.Request) {
+	secure := useSecureCookies(request)
+	cookies := []*http.Cookie{
+		{Name: "authorized"},
+		{Name: accessKeyCookie, Path: "/", HttpOnly: true, Secure: secure, SameSite: http.SameSiteStrictMode},
+		{Name: refreshTokenCookie, Path: "/refresh", HttpOnly: true, Secure: secure, SameSite: http.SameSiteStrictMode},
+		{Name: csrfTokenCookie, Path: "/", Secure: secure, SameSite: http.SameSiteStrictMode},
+	}
+	for _, cookie := range cookies {
+		cookie.Expires = time.Unix(0, 0)
+		http.SetCookie(response, cookie)
+	}
+}
+
+/* The access key from the Authorization header,
+ * or from the cookie if the header is missing
+ */
+func getAccessKey(request *http.Request) (string, bool) {
+	if accessKey := request.Header.Get("Authorization"); accessKey != "" {
+		return accessKey, false
+	}
+
+	cookie, err := request.Cookie(accessKeyCookie)
+	if err != nil {
+		return "", false
+	}
+
+	return cookie.Value, true
+}
+
+/* Double submit: other sites can make the browser send cookies,
+ * but can't read the csrfToken cookie to repeat it in the header
+ */
+func checkCsrfToken(request *http.Request) bool {
+	cookie, err := request.Cookie(csrfTokenCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+
+	headerToken := request.Header.Get(csrfTokenHeader)
+	return subtle.ConstantTimeCompare([]byte(headerToken), []byte(cookie.Value)) == 1
+}
+
+func handleLogout(response http.ResponseWriter, request *http.Request) {
 	if request.Method != "POST" {
 		io.WriteString(response, `{"error":"Wrong method"}`)
 		return
 	}
 
-	db, authorized, userId := checkAccessKey(response, request)
+	db, authorized, _ := checkAccessKey(response, request)
 	if !authorized {
 		return
 	}
 	defer db.Close()
 
-	var credentials struct {
-		ChatName     string `json:"chatName"`
-		ChatPassword string `json:"chatPassword"`
-	}
-	jsonDecoder := json.NewDecoder(request.Body)
-	err := jsonDecoder.Decode(&credentials)
+	accessKey, _ := getAccessKey(request)
+	err := db.DeleteAccessKey(accessKey)
 	if err != nil {
-		io.WriteString(response, `{"error":"Can't parse json"}`)
+		io.WriteString(response, `{"error":"Server internal error"}`)
 		return
 	}
 
-	chatId, err := db.EnterChat(userId, credentials.ChatName, credentials.ChatPassword)
-	if err != nil {
-		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+	clearAuthCookies(response, request)
+	io.WriteString(response, `{"success":true}`)
+}
+
+func handleGetSessions(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
 		return
 	}
 
-	chat, err := db.GetChat(userId, chatId, true, true)
+	db, authorized, userId := checkAccessKey(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	accessKey, _ := getAccessKey(request)
+	sessions, err := db.GetSessions(userId, accessKey)
 	if err != nil {
-		io.WriteString(response, `{"error":"Internal Server Error"}`)
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
 		return
 	}
 
 	responseStruct := struct {
-		Chat database.ChatInformation `json:"chat"`
-	}{*chat}
+		Sessions []database.Session `json:"sessions"`
+	}{sessions}
 
 	jsonEncoder := json.NewEncoder(response)
 	jsonEncoder.Encode(responseStruct)
 }
 
-func handleCreateChat(response http.ResponseWriter, request *http.Request) {
+func handleRevokeSession(response http.ResponseWriter, request *http.Request) {
 	if request.Method != "POST" {
 		io.WriteString(response, `{"error":"Wrong method"}`)
 		return
@@ -546,50 +749,85 @@ func handleCreateChat(response http.ResponseWriter, request *http.Request) {
 	}
 	defer db.Close()
 
-	var credentials struct {
-		ChatName     string `json:"chatName"`
-		ChatPassword string `json:"chatPassword"`
+	var params struct {
+		SessionId        *int `json:"sessionId"`
+		AllExceptCurrent bool `json:"allExceptCurrent"`
 	}
-	jsonDecoder := json.NewDecoder(request.Body)
-	err := jsonDecoder.Decode(&credentials)
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&params)
 	if err != nil {
 		io.WriteString(response, `{"error":"Can't parse json"}`)
 		return
 	}
 
-	validChatName := regexp.MustCompile(`^[a-zA-Z0-9_-]{5,16}$`)
-	if !validChatName.MatchString(credentials.ChatName) {
-		io.WriteString(response, `{"error":"Invalid chat name"}`)
+	if params.AllExceptCurrent {
+		accessKey, _ := getAccessKey(request)
+		err = db.RevokeOtherSessions(userId, accessKey)
+	} else if params.SessionId != nil {
+		err = db.RevokeSession(userId, *params.SessionId)
+	} else {
+		io.WriteString(response, `{"error":"Incorrect params"}`)
+		return
+	}
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
 		return
 	}
 
-	passwordLength := len(credentials.ChatPassword)
-	if passwordLength > 32 {
+	io.WriteString(response, `{"success":true}`)
+
+	closeRevokedSessionSockets(db, userId)
+}
+
+func handleChangePassword(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId := checkAccessKey(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var data struct {
+		OldPassword string `json:"oldPassword"`
+		NewPassword string `json:"newPassword"`
+	}
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	passwordLength := len(data.NewPassword)
+	if passwordLength < 7 || passwordLength > 32 {
 		io.WriteString(response, `{"error":"Invalid password length"}`)
 		return
 	}
 
-	chatId, err := db.CreateChat(userId, credentials.ChatName, credentials.ChatPassword)
+	err = db.ChangePassword(userId, data.OldPassword, data.NewPassword)
 	if err != nil {
-		io.WriteString(response, `{"error":"Chat name already taken"}`)
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
 		return
 	}
 
-	chat, err := db.GetChat(userId, chatId, true, true)
+	accessKey, _ := getAccessKey(request)
+	err = db.RevokeOtherSessions(userId, accessKey)
 	if err != nil {
-		io.WriteString(response, `{"error":"Server Internal Error"}`)
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
 		return
 	}
 
-	responseStruct := struct {
-		Chat database.ChatInformation `json:"chat"`
-	}{*chat}
+	io.WriteString(response, `{"success":true}`)
 
-	jsonEncoder := json.NewEncoder(response)
-	jsonEncoder.Encode(responseStruct)
+	closeRevokedSessionSockets(db, userId)
 }
 
-func handleLeaveChat(response http.ResponseWriter, request *http.Request) {
+func handleDeleteAccount(response http.ResponseWriter, request *http.Request) {
 	if request.Method != "POST" {
 		io.WriteString(response, `{"error":"Wrong method"}`)
 		return
@@ -601,69 +839,168 @@ func handleLeaveChat(response http.ResponseWriter, request *http.Request) {
 	}
 	defer db.Close()
 
-	var dataStruct struct {
-		ChatId int `json:"chatId"`
+	var data struct {
+		Password string `json:"password"`
 	}
-	jsonDecoder := json.NewDecoder(request.Body)
-	err := jsonDecoder.Decode(&dataStruct)
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&data)
 	if err != nil {
 		io.WriteString(response, `{"error":"Can't parse json"}`)
 		return
 	}
 
-	userInChat := db.IsUserInChat(userId, dataStruct.ChatId)
-	if !userInChat {
-		io.WriteString(response, `{"error":"Chat not found"}`)
+	err = db.CheckUserPassword(userId, data.Password)
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
 		return
 	}
 
-	err = db.RemoveChatMember(userId, dataStruct.ChatId)
+	err = deleteAccount(db, userId)
 	if err != nil {
-		io.WriteString(response, `{"error":"Server Internal Error"}`)
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
 		return
 	}
 
-	responseStruct := struct {
-		Success bool `json:"success"`
-	}{true}
+	clearAuthCookies(response, request)
+	io.WriteString(response, `{"success":true}`)
 
-	encoder := json.NewEncoder(response)
-	encoder.Encode(responseStruct)
+	closeRevokedSessionSockets(db, userId)
+}
 
-	if eventBus, exists := eventBus.Chats[dataStruct.ChatId]; exists {
-		eventBus.Mutex.Lock()
+/* Removes the user from all chats and deletes the account,
+ * bots owned by the user are deleted too
+ */
+func deleteAccount(db database.DB, userId int) error {
+	bots, err := db.GetUserBots(userId)
+	if err != nil {
+		return err
+	}
 
-		var message struct {
-			Event     string `json:"event"`
-			EventData struct {
-				ChatId int `json:"chatId"`
-				UserId int `json:"userId"`
-			} `json:"eventData"`
-		}
-		message.Event = "chatMemberLeft"
-		message.EventData.ChatId = dataStruct.ChatId
-		message.EventData.UserId = userId
-		jsonMessage, err := json.Marshal(message)
+	for _, bot := range bots {
+		err = deleteAccount(db, bot.Id)
 		if err != nil {
-			log.Println(err)
-			return
+			return err
 		}
+	}
 
-		wg := sync.WaitGroup{}
-		for _, subscriber := range eventBus.Sockets {
-			wg.Add(1)
-			go func(subscriber *ws.Conn) {
-				subscriber.WriteMessage(ws.TextMessage, jsonMessage)
-				wg.Done()
-			}(subscriber)
+	chats, err := db.GetUserChats(userId)
+	if err != nil {
+		return err
+	}
+
+	for _, chat := range chats {
+		err = leaveChat(db, userId, chat.Id)
+		if err != nil {
+			return err
 		}
-		wg.Wait()
+	}
+
+	user, _ := db.GetUser(userId)
+
+	err = db.DeleteUser(userId)
+	if err != nil {
+		return err
+	}
 
-		eventBus.Mutex.Unlock()
+	if user.AvatarHash != "" {
+		removeAttachmentFiles([]string{user.AvatarHash})
 	}
+
+	return nil
 }
 
-func handleDeleteMessages(response http.ResponseWriter, request *http.Request) {
+/* Removes the member from the chat, passing ownership on
+ * or deleting the chat if the owner was its last member
+ */
+func leaveChat(db database.DB, userId, chatId int) error {
+	newOwnerId, lastMember, err := db.LeaveChat(userId, chatId)
+	if err != nil {
+		return err
+	}
+
+	/* The last member takes the chat with them */
+	if lastMember {
+		return deleteChat(db, chatId, userId)
+	}
+
+	if newOwnerId != 0 {
+		broadcastRoleChange(db, chatId, newOwnerId, database.RoleOwner)
+	}
+	broadcastMemberLeft(db, chatId, userId)
+	unsubscribeFromChat(userId, chatId)
+
+	return nil
+}
+
+func broadcastMemberLeft(db database.DB, chatId, userId int) {
+	var message struct {
+		Event     string `json:"event"`
+		EventData struct {
+			ChatId int `json:"chatId"`
+			UserId int `json:"userId"`
+		} `json:"eventData"`
+	}
+	message.Event = "chatMemberLeft"
+	message.EventData.ChatId = chatId
+	message.EventData.UserId = userId
+	broadcastChatEvent(db, chatId, message, nil)
+}
+
+/* Removes the chat with its messages and attachment files,
+ * then tells subscribers and drops the chat's event bus.
+ * Bots get the event from DeleteChat, before their memberships are gone.
+ */
+func deleteChat(db database.DB, chatId, deletedBy int) error {
+	var message struct {
+		Event     string `json:"event"`
+		EventData struct {
+			ChatId    int `json:"chatId"`
+			DeletedBy int `json:"deletedBy"`
+		} `json:"eventData"`
+	}
+	message.Event = "chatDeleted"
+	message.EventData.ChatId = chatId
+	message.EventData.DeletedBy = deletedBy
+	jsonMessage, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	attachmentHashes, botIds, err := db.DeleteChat(chatId, jsonMessage)
+	removeAttachmentFiles(attachmentHashes)
+	notifyBots(botIds)
+	if err != nil {
+		return err
+	}
+
+	writeToChatsSubscribers([]int{chatId}, jsonMessage, nil)
+
+	eventBus.Mutex.Lock()
+	if chatEventBus, exists := eventBus.Chats[chatId]; exists {
+		chatEventBus.Mutex.Lock()
+		delete(eventBus.Chats, chatId)
+		chatEventBus.Sockets = nil
+		chatEventBus.Mutex.Unlock()
+	}
+	eventBus.Mutex.Unlock()
+
+	return nil
+}
+
+func removeAttachmentFiles(hashes []string) {
+	for _, hash := range hashes {
+		err := os.Remove(fmt.Sprintf("attachments/%s", hash))
+		if err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+	}
+}
+
+/* Bots send "Authorization: Bot <token>" instead of an access key */
+const botTokenPrefix = "Bot "
+
+func handleCreateBot(response http.ResponseWriter, request *http.Request) {
 	if request.Method != "POST" {
 		io.WriteString(response, `{"error":"Wrong method"}`)
 		return
@@ -675,154 +1012,3043 @@ func handleDeleteMessages(response http.ResponseWriter, request *http.Request) {
 	}
 	defer db.Close()
 
-	var dataStruct struct {
-		ChatId     int   `json:"chatId"`
-		MessageIds []int `json:"messageIds"`
+	if db.IsBot(userId) {
+		io.WriteString(response, `{"error":"Bots can't create bots"}`)
+		return
 	}
-	jsonDecoder := json.NewDecoder(request.Body)
-	err := jsonDecoder.Decode(&dataStruct)
-	if err != nil {
+
+	var data struct {
+		Username string `json:"username"`
+	}
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	validUsername := regexp.MustCompile(`^[a-zA-Z0-9_-]{5,16}$`)
+	if !validUsername.MatchString(data.Username) {
+		io.WriteString(response, `{"error":"Invalid username"}`)
+		return
+	}
+
+	bot, token, err := db.CreateBot(userId, data.Username)
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	responseStruct := struct {
+		Bot   database.User `json:"bot"`
+		Token string        `json:"token"`
+	}{bot, token}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+func handleGetMyBots(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId := checkAccessKey(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	bots, err := db.GetUserBots(userId)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+
+	responseStruct := struct {
+		Bots []database.User `json:"bots"`
+	}{bots}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+func handleRegenerateBotToken(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId := checkAccessKey(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var data struct {
+		BotId int `json:"botId"`
+	}
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	token, err := db.RegenerateBotToken(userId, data.BotId)
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	io.WriteString(response, fmt.Sprintf(`{"token":"%s"}`, token))
+}
+
+/* Long polling for bots without a webhook.
+ * Passing offset confirms all updates with lower ids.
+ */
+func handleGetUpdates(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId := checkAccessKey(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	if !db.IsBot(userId) {
+		io.WriteString(response, `{"error":"Only bots can get updates"}`)
+		return
+	}
+
+	if db.GetBotWebhook(userId) != "" {
+		io.WriteString(response, `{"error":"Webhook is set"}`)
+		return
+	}
+
+	offset := 0
+	if offsetString := request.URL.Query().Get("offset"); offsetString != "" {
+		var err error
+		offset, err = strconv.Atoi(offsetString)
+		if err != nil {
+			io.WriteString(response, `{"error":"Invalid parameter \"offset\" specified"}`)
+			return
+		}
+	}
+
+	timeout := 0
+	if timeoutString := request.URL.Query().Get("timeout"); timeoutString != "" {
+		var err error
+		timeout, err = strconv.Atoi(timeoutString)
+		if err != nil || timeout < 0 || timeout > 50 {
+			io.WriteString(response, `{"error":"Invalid parameter \"timeout\" specified"}`)
+			return
+		}
+	}
+
+	deadline := time.After(time.Duration(timeout) * time.Second)
+	for {
+		/* Subscribe before querying, so updates added in between aren't missed */
+		newUpdates := waitForBotUpdates(userId)
+
+		updates, err := db.GetBotUpdates(userId, offset, 100)
+		if err != nil {
+			log.Println(err)
+			io.WriteString(response, `{"error":"Server internal error"}`)
+			return
+		}
+
+		if len(updates) > 0 || timeout == 0 {
+			responseStruct := struct {
+				Updates []database.BotUpdate `json:"updates"`
+			}{updates}
+
+			jsonEncoder := json.NewEncoder(response)
+			jsonEncoder.Encode(responseStruct)
+			return
+		}
+
+		select {
+		case <-newUpdates:
+		case <-deadline:
+			timeout = 0
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
+
+func handleSetWebhook(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId := checkAccessKey(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	if !db.IsBot(userId) {
+		io.WriteString(response, `{"error":"Only bots can set webhooks"}`)
+		return
+	}
+
+	var data struct {
+		Url string `json:"url"`
+	}
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	/* Empty url removes the webhook */
+	if data.Url != "" {
+		webhookUrl, err := url.Parse(data.Url)
+		if err != nil || (webhookUrl.Scheme != "http" && webhookUrl.Scheme != "https") || webhookUrl.Hostname() == "" || len(data.Url) > 512 {
+			io.WriteString(response, `{"error":"Invalid url"}`)
+			return
+		}
+
+		/* Hostnames are checked on every delivery, literal addresses can be refused right away */
+		if ip := net.ParseIP(webhookUrl.Hostname()); (ip != nil && !isWebhookAddressAllowed(ip)) || strings.EqualFold(webhookUrl.Hostname(), "localhost") {
+			io.WriteString(response, `{"error":"Webhook url must point to a public host"}`)
+			return
+		}
+	}
+
+	err = db.SetBotWebhook(userId, data.Url)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+
+	io.WriteString(response, `{"success":true}`)
+
+	if data.Url != "" {
+		go deliverWebhookUpdates(userId)
+	}
+}
+
+var botUpdatesWaiters = struct {
+	Mutex    sync.Mutex
+	Channels map[int]chan struct{}
+}{Channels: make(map[int]chan struct{})}
+
+/* Returns a channel closed when the bot gets new updates */
+func waitForBotUpdates(botId int) <-chan struct{} {
+	botUpdatesWaiters.Mutex.Lock()
+	defer botUpdatesWaiters.Mutex.Unlock()
+
+	channel, exists := botUpdatesWaiters.Channels[botId]
+	if !exists {
+		channel = make(chan struct{})
+		botUpdatesWaiters.Channels[botId] = channel
+	}
+
+	return channel
+}
+
+func notifyBotUpdates(botId int) {
+	botUpdatesWaiters.Mutex.Lock()
+	defer botUpdatesWaiters.Mutex.Unlock()
+
+	if channel, exists := botUpdatesWaiters.Channels[botId]; exists {
+		close(channel)
+		delete(botUpdatesWaiters.Channels, botId)
+	}
+}
+
+/* Puts the event into update queues of bots in the chat */
+func queueBotUpdates(db database.DB, chatId int, jsonMessage []byte, excludedUserIds map[int]bool) {
+	botIds, err := db.AddBotUpdates(chatId, jsonMessage, excludedUserIds)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	notifyBots(botIds)
+}
+
+/* Wakes long polls and starts webhook deliveries for the bots */
+func notifyBots(botIds []int) {
+	for _, botId := range botIds {
+		notifyBotUpdates(botId)
+		go deliverWebhookUpdates(botId)
+	}
+}
+
+/* Webhooks must not reach the server itself or hosts of its network */
+var blockedWebhookNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+func isWebhookAddressAllowed(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range blockedWebhookNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+/* Checks the address actually being dialed, after DNS resolution,
+ * so hostnames resolving to internal addresses are refused too
+ */
+func checkWebhookDial(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isWebhookAddressAllowed(ip) {
+		return fmt.Errorf("webhook address %s is not allowed", host)
+	}
+
+	return nil
+}
+
+var webhookClient = &http.Client{
+	Timeout: time.Second * 10,
+	Transport: &http.Transport{
+		/* A proxy would be dialed instead of the webhook host */
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: time.Second * 5,
+			Control: checkWebhookDial,
+		}).DialContext,
+		TLSHandshakeTimeout: time.Second * 5,
+		MaxIdleConnsPerHost: 2,
+	},
+	/* Redirect responses count as failed deliveries */
+	CheckRedirect: func(request *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+/* One delivery per bot at a time, so updates arrive in order */
+var webhookDeliveries = struct {
+	Mutex  sync.Mutex
+	Active map[int]bool
+}{Active: make(map[int]bool)}
+
+/* Posts pending updates to the bot's webhook one by one,
+ * stops at the first failure and leaves the rest for retryWebhooks
+ */
+func deliverWebhookUpdates(botId int) {
+	webhookDeliveries.Mutex.Lock()
+	if webhookDeliveries.Active[botId] {
+		webhookDeliveries.Mutex.Unlock()
+		return
+	}
+	webhookDeliveries.Active[botId] = true
+	webhookDeliveries.Mutex.Unlock()
+
+	defer func() {
+		webhookDeliveries.Mutex.Lock()
+		delete(webhookDeliveries.Active, botId)
+		webhookDeliveries.Mutex.Unlock()
+	}()
+
+	db, err := openSqlConnection()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer db.Close()
+
+	webhookUrl := db.GetBotWebhook(botId)
+	if webhookUrl == "" {
+		return
+	}
+
+	for {
+		updates, err := db.GetBotUpdates(botId, 0, 100)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if len(updates) == 0 {
+			return
+		}
+
+		for _, update := range updates {
+			body, err := json.Marshal(update)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+
+			webhookResponse, err := webhookClient.Post(webhookUrl, "application/json", bytes.NewReader(body))
+			if err != nil {
+				log.Println("Webhook delivery failed", botId, err)
+				return
+			}
+			webhookResponse.Body.Close()
+			if webhookResponse.StatusCode < 200 || webhookResponse.StatusCode >= 300 {
+				log.Println("Webhook delivery failed", botId, webhookResponse.Status)
+				return
+			}
+
+			err = db.DeleteBotUpdate(botId, update.Id)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+		}
+	}
+}
+
+func retryWebhooks(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		db, err := openSqlConnection()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		botIds, err := db.GetBotsWithPendingWebhooks()
+		db.Close()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		for _, botId := range botIds {
+			go deliverWebhookUpdates(botId)
+		}
+	}
+}
+
+/* Personal API tokens are sent as "Authorization: Token <token>" */
+const apiTokenPrefix = "Token "
+
+/* Methods available to personal API tokens and the scopes they need,
+ * "" means any token will do. Methods not listed need a session.
+ * Deleting messages has its own scope, since it also removes other members'
+ * messages where the role allows it, which sending doesn't imply.
+ */
+var endpointScopes = map[string]string{
+	"/getMe":             "",
+	"/getUser":           "",
+	"/getChats":          database.ScopeReadMessages,
+	"/getChat":           database.ScopeReadMessages,
+	"/getMessages":       database.ScopeReadMessages,
+	"/sendMessage":       database.ScopeSendMessages,
+	"/deleteMessages":    database.ScopeDeleteMessages,
+	"/createChat":        database.ScopeManageChats,
+	"/enterChat":         database.ScopeManageChats,
+	"/leaveChat":         database.ScopeManageChats,
+	"/startDirectChat":   database.ScopeManageChats,
+	"/createInvite":      database.ScopeManageChats,
+	"/getInvites":        database.ScopeManageChats,
+	"/revokeInvite":      database.ScopeManageChats,
+	"/joinByInvite":      database.ScopeManageChats,
+	"/setMemberRole":     database.ScopeManageChats,
+	"/kickMember":        database.ScopeManageChats,
+	"/banMember":         database.ScopeManageChats,
+	"/unbanMember":       database.ScopeManageChats,
+	"/getBannedMembers":  database.ScopeManageChats,
+	"/transferOwnership": database.ScopeManageChats,
+	"/updateChat":        database.ScopeManageChats,
+	"/deleteChat":        database.ScopeManageChats,
+}
+
+func handleCreateApiToken(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId := checkAccessKey(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	if db.IsBot(userId) {
+		io.WriteString(response, `{"error":"Bots can't have API tokens"}`)
+		return
+	}
+
+	var data struct {
+		Name    string   `json:"name"`
+		Scopes  []string `json:"scopes"`
+		ChatIds []int    `json:"chatIds"`
+	}
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	data.Name = strings.TrimSpace(data.Name)
+	if data.Name == "" || utf8.RuneCountInString(data.Name) > 64 {
+		io.WriteString(response, `{"error":"Invalid token name"}`)
+		return
+	}
+	if len(data.Scopes) == 0 {
+		io.WriteString(response, `{"error":"No scopes specified"}`)
+		return
+	}
+	if len(data.ChatIds) > 100 {
+		io.WriteString(response, `{"error":"Too many chats"}`)
+		return
+	}
+
+	token, apiToken, err := db.CreateApiToken(userId, data.Name, data.Scopes, data.ChatIds)
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	/* The token is shown only once */
+	responseStruct := struct {
+		Token    string            `json:"token"`
+		ApiToken database.ApiToken `json:"apiToken"`
+	}{token, apiToken}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+func handleGetApiTokens(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId := checkAccessKey(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	tokens, err := db.GetApiTokens(userId)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+
+	responseStruct := struct {
+		ApiTokens []database.ApiToken `json:"apiTokens"`
+	}{tokens}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+func handleRevokeApiToken(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId := checkAccessKey(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var data struct {
+		TokenId int `json:"tokenId"`
+	}
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	err = db.RevokeApiToken(userId, data.TokenId)
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	io.WriteString(response, `{"success":true}`)
+}
+
+/* Personal API tokens may be limited to some chats,
+ * other credentials (apiToken is nil for them) have access to all chats of the user
+ */
+func checkChatAccess(response http.ResponseWriter, apiToken *database.ApiToken, chatId int) bool {
+	if !chatAllowed(apiToken, chatId) {
+		io.WriteString(response, `{"error":"Access denied"}`)
+		return false
+	}
+	return true
+}
+
+func chatAllowed(apiToken *database.ApiToken, chatId int) bool {
+	return apiToken == nil || apiToken.AllowsChat(chatId)
+}
+
+func checkAccessKey(response http.ResponseWriter, request *http.Request) (database.DB, bool, int) {
+	db, authorized, userId, _ := checkCredentials(response, request)
+	return db, authorized, userId
+}
+
+/* Same as checkAccessKey, also returns the personal API token
+ * the request was made with, for chat restrictions of the token
+ */
+func checkCredentials(response http.ResponseWriter, request *http.Request) (database.DB, bool, int, *database.ApiToken) {
+	accessKey, fromCookie := getAccessKey(request)
+
+	db, err := openSqlConnection()
+	if err != nil {
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return db, false, 0, nil
+	}
+
+	var (
+		authorized bool
+		userId     int
+		apiToken   *database.ApiToken
+	)
+	if strings.HasPrefix(accessKey, botTokenPrefix) {
+		authorized, userId = db.ValidateBotToken(strings.TrimPrefix(accessKey, botTokenPrefix))
+	} else if strings.HasPrefix(accessKey, apiTokenPrefix) {
+		var token database.ApiToken
+		token, authorized = db.ValidateApiToken(strings.TrimPrefix(accessKey, apiTokenPrefix))
+		userId, apiToken = token.UserId, &token
+
+		scope, available := endpointScopes[request.URL.Path]
+		if authorized && (!available || (scope != "" && !apiToken.HasScope(scope))) {
+			io.WriteString(response, `{"error":"Token has no access to this method"}`)
+			db.Close()
+			return db, false, 0, nil
+		}
+	} else {
+		authorized, userId = db.ValidateAccessKey(accessKey)
+		if authorized {
+			presenceActivity(userId)
+		}
+	}
+
+	/* Browsers attach cookies to cross-site requests too */
+	if authorized && fromCookie && request.Method != "GET" && !checkCsrfToken(request) {
+		io.WriteString(response, `{"error":"Invalid CSRF token"}`)
+		db.Close()
+		return db, false, 0, nil
+	}
+
+	if !authorized {
+		cookie := &http.Cookie{
+			Name:    "authorized",
+			Expires: time.Unix(0, 0),
+		}
+		http.SetCookie(response, cookie)
+		io.WriteString(response, `{"error":"Invalid access key","errorCode":1}`)
+		db.Close()
+	}
+
+	return db, authorized, userId, apiToken
+}
+
+func handleGetMe(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId := checkAccessKey(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	/* I know this "exists" may be useless,
+	 * but what if user asynchronously deleted after checking accessKey?
+	 */
+	user, exists := db.GetUser(userId)
+	if !exists {
+		io.WriteString(response, `{"error":"User not found"}`)
+		return
+	}
+	user.Status, user.LastSeenTs = getPresence(user.Id, user.LastSeenTs)
+
+	responseStruct := struct {
+		User database.User `json:"user"`
+	}{user}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+func handleGetUser(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, _ := checkAccessKey(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	userIdString := request.URL.Query().Get("id")
+	if userIdString == "" {
+		io.WriteString(response, `{"error":"No parameter \"id\" specified"}`)
+		return
+	}
+
+	userId, err := strconv.Atoi(userIdString)
+	if err != nil {
+		io.WriteString(response, `{"error":"Invalid parameter \"id\" specified"}`)
+		return
+	}
+
+	user, exists := db.GetUser(userId)
+	if !exists {
+		io.WriteString(response, `{"error":"User not found"}`)
+		return
+	}
+	user.Status, user.LastSeenTs = getPresence(user.Id, user.LastSeenTs)
+
+	responseStruct := struct {
+		User database.User `json:"user"`
+	}{user}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+func handleSearchUsers(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId := checkAccessKey(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	if allowed, retryAfter := searchRequests.Allow(strconv.Itoa(userId)); !allowed {
+		writeTooManyAttempts(response, retryAfter)
+		return
+	}
+
+	searchQuery := strings.TrimSpace(request.URL.Query().Get("q"))
+	if searchQuery == "" || utf8.RuneCountInString(searchQuery) > 32 {
+		io.WriteString(response, `{"error":"Invalid parameter \"q\" specified"}`)
+		return
+	}
+
+	offset, count, ok := parsePagination(response, request)
+	if !ok {
+		return
+	}
+
+	users, err := db.SearchUsers(userId, searchQuery, offset, count)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+	for i := range users {
+		users[i].Status, users[i].LastSeenTs = getPresence(users[i].Id, users[i].LastSeenTs)
+	}
+
+	responseStruct := struct {
+		Users []database.User `json:"users"`
+	}{users}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+/* Reads optional "offset" and "count" query parameters,
+ * writes the error itself if they are invalid
+ */
+func parsePagination(response http.ResponseWriter, request *http.Request) (int, int, bool) {
+	offset := 0
+	if offsetString := request.URL.Query().Get("offset"); offsetString != "" {
+		var err error
+		offset, err = strconv.Atoi(offsetString)
+		if err != nil || offset < 0 {
+			io.WriteString(response, `{"error":"Invalid parameter \"offset\" specified"}`)
+			return 0, 0, false
+		}
+	}
+
+	count := 20
+	if countString := request.URL.Query().Get("count"); countString != "" {
+		var err error
+		count, err = strconv.Atoi(countString)
+		if err != nil || count < 1 || count > 50 {
+			io.WriteString(response, `{"error":"Invalid parameter \"count\" specified"}`)
+			return 0, 0, false
+		}
+	}
+
+	return offset, count, true
+}
+
+func handleBlockUser(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId := checkAccessKey(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var params struct {
+		UserId int `json:"userId"`
+	}
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	err = db.BlockUser(userId, params.UserId)
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	io.WriteString(response, `{"success":true}`)
+}
+
+func handleUnblockUser(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId := checkAccessKey(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var params struct {
+		UserId int `json:"userId"`
+	}
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	err = db.UnblockUser(userId, params.UserId)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+
+	io.WriteString(response, `{"success":true}`)
+}
+
+func handleGetBlockedUsers(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId := checkAccessKey(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	users, err := db.GetBlockedUsers(userId)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+
+	responseStruct := struct {
+		Users []database.User `json:"users"`
+	}{users}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+func handleUpdateProfile(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId := checkAccessKey(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var params struct {
+		DisplayName  *string `json:"displayName"`
+		Bio          *string `json:"bio"`
+		Avatar       *string `json:"avatar"`
+		RemoveAvatar bool    `json:"removeAvatar"`
+	}
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	user, exists := db.GetUser(userId)
+	if !exists {
+		io.WriteString(response, `{"error":"User not found"}`)
+		return
+	}
+
+	if params.DisplayName != nil {
+		user.DisplayName = strings.TrimSpace(*params.DisplayName)
+		if utf8.RuneCountInString(user.DisplayName) > 32 {
+			io.WriteString(response, `{"error":"Invalid display name length"}`)
+			return
+		}
+	}
+
+	if params.Bio != nil {
+		user.Bio = strings.TrimSpace(*params.Bio)
+		if utf8.RuneCountInString(user.Bio) > 256 {
+			io.WriteString(response, `{"error":"Invalid bio length"}`)
+			return
+		}
+	}
+
+	var avatar []byte
+	if params.Avatar != nil {
+		avatar, err = base64.StdEncoding.DecodeString(*params.Avatar)
+		if err != nil {
+			io.WriteString(response, `{"error":"Can't parse avatar"}`)
+			return
+		}
+		if len(avatar) > 1024*1024 {
+			io.WriteString(response, `{"error":"Avatar is too big"}`)
+			return
+		}
+		if !strings.HasPrefix(http.DetectContentType(avatar), "image/") {
+			io.WriteString(response, `{"error":"Avatar is not an image"}`)
+			return
+		}
+	}
+
+	err = db.UpdateProfile(userId, user.DisplayName, user.Bio)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+
+	if avatar != nil || params.RemoveAvatar {
+		avatarHash := ""
+		if avatar != nil {
+			stringToEncode := fmt.Sprintf("user%davatar%d", userId, time.Now().UnixNano())
+			hash := sha256.Sum256([]byte(stringToEncode))
+			avatarHash = hex.EncodeToString(hash[:])
+
+			err = ioutil.WriteFile(fmt.Sprintf("attachments/%s", avatarHash), avatar, 0755)
+			if err != nil {
+				log.Println(err)
+				io.WriteString(response, `{"error":"Server internal error"}`)
+				return
+			}
+		}
+
+		oldAvatarHash, err := db.SetAvatar(userId, avatarHash)
+		if err != nil {
+			log.Println(err)
+			io.WriteString(response, `{"error":"Server internal error"}`)
+			return
+		}
+		if oldAvatarHash != "" {
+			removeAttachmentFiles([]string{oldAvatarHash})
+		}
+		user.AvatarHash = avatarHash
+	}
+
+	responseStruct := struct {
+		User database.User `json:"user"`
+	}{user}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+
+	chats, err := db.GetUserChats(userId)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	chatIds := make([]int, len(chats))
+	for i, chat := range chats {
+		chatIds[i] = chat.Id
+	}
+
+	var message struct {
+		Event     string        `json:"event"`
+		EventData database.User `json:"eventData"`
+	}
+	message.Event = "profileUpdated"
+	message.EventData = user
+	broadcastToChats(chatIds, message)
+}
+
+func handleGetChats(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	chats, err := db.GetUserChats(userId)
+	if err != nil {
+		io.WriteString(response, `{"error":"Server interval error"}`)
+		return
+	}
+
+	allowedChats := []database.Chat{}
+	for _, chat := range chats {
+		if chatAllowed(apiToken, chat.Id) {
+			allowedChats = append(allowedChats, chat)
+		}
+	}
+	chats = allowedChats
+
+	var result struct {
+		Chats []database.Chat `json:"chats"`
+	}
+	result.Chats = chats
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(result)
+}
+
+func handleGetChat(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	chatId, err := strconv.Atoi(request.URL.Query().Get("id"))
+	if err != nil {
+		io.WriteString(response, `{"error":"Incorrect chatId"}`)
+		return
+	}
+
+	if !checkChatAccess(response, apiToken, chatId) {
+		return
+	}
+
+	var responseStruct struct {
+		Chat database.ChatInformation `json:"chat"`
+	}
+	chat, err := db.GetChat(userId, chatId, true, true)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Access denied"}`)
+		return
+	}
+	fillMembersPresence(chat)
+	responseStruct.Chat = *chat
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+func handleSendMessage(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+	attachmentsWaitGroup := sync.WaitGroup{}
+
+	var params struct {
+		ChatId      *int      `json:"chatId"`
+		Text        *string   `json:"text"`
+		Attachments *[]string `json:"attachments"`
+	}
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&params)
+	if err != nil {
+		io.WriteString(response, `{"error":"Invalid request body"}`)
+		return
+	}
+
+	if params.ChatId == nil || params.Text == nil {
+		io.WriteString(response, `{"error":"Incorrect params"}`)
+		return
+	}
+
+	if !checkChatAccess(response, apiToken, *params.ChatId) {
+		return
+	}
+
+	*params.Text = strings.TrimSpace(*params.Text)
+	if *params.Text == "" || len(*params.Text) > 2048 {
+		io.WriteString(response, `{"error":"Incorrect text param"}`)
+		return
+	}
+
+	messageId, err := db.AddMessage(*params.ChatId, userId, *params.Text)
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	io.WriteString(response, fmt.Sprintf(`{"messageId":%d}`, messageId))
+
+	type Attachment struct {
+		ContentType string `json:"contentType"`
+		Hash        string `json:"hash"`
+	}
+	var attachments []Attachment
+	if params.Attachments != nil {
+		attachmentsCount := len(*params.Attachments)
+		if attachmentsCount > 0 {
+			attachments = make([]Attachment, attachmentsCount)
+			for i, base64attachment := range *params.Attachments {
+				binaryAttachment, err := base64.StdEncoding.DecodeString(base64attachment)
+				if err != nil {
+					log.Println("Error parsing base64", err.Error())
+					continue
+				}
+
+				bytesToDetectContentType := 512
+				attachmentBinaryLength := len(binaryAttachment)
+				if attachmentBinaryLength < 512 {
+					bytesToDetectContentType = attachmentBinaryLength
+				}
+				attachmentContentType := http.DetectContentType(binaryAttachment[:bytesToDetectContentType])
+
+				stringToEncode := fmt.Sprintf("chat%dmessage%dIAmLuman%d", params.ChatId, messageId, i)
+				hash := sha256.Sum256([]byte(stringToEncode))
+				hashString := hex.EncodeToString(hash[:])
+
+				attachmentsWaitGroup.Add(2)
+				go func() {
+					filePath := fmt.Sprintf("attachments/%s", hashString)
+					ioutil.WriteFile(filePath, binaryAttachment, 0755)
+					attachmentsWaitGroup.Done()
+				}()
+
+				go func() {
+					db.AddAttachment(*params.ChatId, messageId, attachmentContentType, hashString)
+					attachmentsWaitGroup.Done()
+				}()
+
+				attachment := Attachment{
+					ContentType: attachmentContentType,
+					Hash:        hashString,
+				}
+
+				attachments[i] = attachment
+			}
+		}
+	}
+
+	var message struct {
+		Event     string `json:"event"`
+		EventData struct {
+			ChatId      int           `json:"chatId"`
+			MessageId   int           `json:"messageId"`
+			SenderId    int           `json:"senderId"`
+			Text        string        `json:"text"`
+			Ts          int           `json:"ts"`
+			Attachments *[]Attachment `json:"attachments,omitempty"`
+		} `json:"eventData"`
+	}
+	message.Event = "newMessage"
+	message.EventData.ChatId = *params.ChatId
+	message.EventData.MessageId = messageId
+	message.EventData.SenderId = userId
+	message.EventData.Text = *params.Text
+	message.EventData.Ts = int(time.Now().Unix())
+	if len(attachments) > 0 {
+		message.EventData.Attachments = &attachments
+	}
+
+	/* Users who blocked the sender don't get the message live */
+	blockerIds, err := db.GetBlockerIds(userId)
+	if err != nil {
+		log.Println(err)
+	}
+	broadcastChatEvent(db, *params.ChatId, message, blockerIds)
+
+	attachmentsWaitGroup.Wait()
+}
+
+func handleGetMessages(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	chatIdString := request.URL.Query().Get("chatId")
+	chatId, err := strconv.Atoi(chatIdString)
+	if err != nil {
+		io.WriteString(response, `{"error":"Invalid \"chatId\" parameter"}`)
+		return
+	}
+
+	userInChat := db.IsUserInChat(userId, chatId)
+	if !userInChat || !chatAllowed(apiToken, chatId) {
+		io.WriteString(response, `{"error":"Access denied"}`)
+		return
+	}
+
+	offsetString := request.URL.Query().Get("offset")
+	offset, err := strconv.Atoi(offsetString)
+	if err != nil {
+		io.WriteString(response, `{"error":"Invalid \"offset\" parameter"}`)
+		return
+	}
+
+	messagesCountString := request.URL.Query().Get("messagesCount")
+	messagesCount := 20
+	if messagesCountString != "" {
+		messagesCount, err = strconv.Atoi(messagesCountString)
+		if err != nil {
+			io.WriteString(response, `{"error":"Invalid \"messagesCount\" parameter"}`)
+			return
+		}
+	}
+
+	withUsernamesString := request.URL.Query().Get("withUsernames")
+	withUsernames := false
+	if withUsernamesString == "true" {
+		withUsernames = true
+	}
+
+	messages, err := db.GetMessages(userId, chatId, offset, messagesCount, withUsernames)
+	if err != nil {
+		io.WriteString(response, `{"error":"Interval Server Error"}`)
+		return
+	}
+
+	var responseStruct struct {
+		Messages []database.Message `json:"messages"`
+	}
+	responseStruct.Messages = messages
+
+	jsonString, err := json.Marshal(responseStruct)
+	if err != nil {
+		io.WriteString(response, `{"error":"Interval Server Error"}`)
+		return
+	}
+
+	response.Write(jsonString)
+}
+
+func handleEnterChat(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	/* Tokens limited to some chats can't get into new ones, there is no chat 0 */
+	if !checkChatAccess(response, apiToken, 0) {
+		return
+	}
+
+	var credentials struct {
+		ChatName     string `json:"chatName"`
+		ChatPassword string `json:"chatPassword"`
+	}
+	jsonDecoder := json.NewDecoder(request.Body)
+	err := jsonDecoder.Decode(&credentials)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	ipKey := "ip:" + getRemoteIp(request)
+	chatKey := "chat:" + credentials.ChatName
+	if retryAfter := enterChatAttempts.RetryAfter(ipKey, chatKey); retryAfter > 0 {
+		writeTooManyAttempts(response, retryAfter)
+		return
+	}
+
+	chatId, err := db.EnterChat(userId, credentials.ChatName, credentials.ChatPassword)
+	if err == database.ErrInvalidChatCredentials {
+		enterChatAttempts.Fail(ipKey, chatKey)
+	} else if err == nil {
+		enterChatAttempts.Reset(chatKey)
+	}
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	chat, err := db.GetChat(userId, chatId, true, true)
+	if err != nil {
+		io.WriteString(response, `{"error":"Internal Server Error"}`)
+		return
+	}
+
+	fillMembersPresence(chat)
+	responseStruct := struct {
+		Chat database.ChatInformation `json:"chat"`
+	}{*chat}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+var validChatName = regexp.MustCompile(`^[a-zA-Z0-9_-]{5,16}$`)
+
+func handleCreateChat(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	/* Tokens limited to some chats can't get into new ones, there is no chat 0 */
+	if !checkChatAccess(response, apiToken, 0) {
+		return
+	}
+
+	var credentials struct {
+		ChatName     string `json:"chatName"`
+		ChatPassword string `json:"chatPassword"`
+	}
+	jsonDecoder := json.NewDecoder(request.Body)
+	err := jsonDecoder.Decode(&credentials)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	if !validChatName.MatchString(credentials.ChatName) {
+		io.WriteString(response, `{"error":"Invalid chat name"}`)
+		return
+	}
+
+	passwordLength := len(credentials.ChatPassword)
+	if passwordLength > 32 {
+		io.WriteString(response, `{"error":"Invalid password length"}`)
+		return
+	}
+
+	chatId, err := db.CreateChat(userId, credentials.ChatName, credentials.ChatPassword)
+	if err != nil {
+		io.WriteString(response, `{"error":"Chat name already taken"}`)
+		return
+	}
+
+	chat, err := db.GetChat(userId, chatId, true, true)
+	if err != nil {
+		io.WriteString(response, `{"error":"Server Internal Error"}`)
+		return
+	}
+
+	fillMembersPresence(chat)
+	responseStruct := struct {
+		Chat database.ChatInformation `json:"chat"`
+	}{*chat}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+func handleStartDirectChat(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	if !checkChatAccess(response, apiToken, 0) {
+		return
+	}
+
+	var data struct {
+		UserId int `json:"userId"`
+	}
+	jsonDecoder := json.NewDecoder(request.Body)
+	err := jsonDecoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	chatId, peerAdded, err := db.StartDirectChat(userId, data.UserId)
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	chat, err := db.GetChat(userId, chatId, true, true)
+	if err != nil {
+		io.WriteString(response, `{"error":"Server Internal Error"}`)
+		return
+	}
+
+	fillMembersPresence(chat)
+	responseStruct := struct {
+		Chat database.ChatInformation `json:"chat"`
+	}{*chat}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+
+	/* So the other user's client can subscribe to the chat */
+	if peerAdded {
+		peerChat, err := db.GetChat(data.UserId, chatId, false, false)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		var message struct {
+			Event     string `json:"event"`
+			EventData struct {
+				Chat database.ChatInformation `json:"chat"`
+			} `json:"eventData"`
+		}
+		message.Event = "directChatStarted"
+		message.EventData.Chat = *peerChat
+		sendToUser(data.UserId, message)
+	}
+}
+
+/* Checks that the user's role in the chat has the permission,
+ * returns the role so callers can compare it with other members' roles
+ */
+func checkChatPermission(response http.ResponseWriter, db database.DB, userId, chatId int, permission string) (string, bool) {
+	role := db.GetMemberRole(chatId, userId)
+	if role == "" {
+		io.WriteString(response, `{"error":"Chat not found"}`)
+		return "", false
+	}
+	if !database.RoleCan(role, permission) {
+		io.WriteString(response, `{"error":"Access denied"}`)
+		return "", false
+	}
+	return role, true
+}
+
+func handleSetMemberRole(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var data struct {
+		ChatId int    `json:"chatId"`
+		UserId int    `json:"userId"`
+		Role   string `json:"role"`
+	}
+	jsonDecoder := json.NewDecoder(request.Body)
+	err := jsonDecoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	if !database.IsValidRole(data.Role) || data.Role == database.RoleOwner {
+		io.WriteString(response, `{"error":"Invalid role"}`)
+		return
+	}
+
+	if !checkChatAccess(response, apiToken, data.ChatId) {
+		return
+	}
+	role, allowed := checkChatPermission(response, db, userId, data.ChatId, database.PermChangeRoles)
+	if !allowed {
+		return
+	}
+
+	if data.UserId == userId {
+		io.WriteString(response, `{"error":"Can't change your own role"}`)
+		return
+	}
+
+	/* Only members of lower roles can be changed, and only to lower roles */
+	memberRole := db.GetMemberRole(data.ChatId, data.UserId)
+	if memberRole == "" {
+		io.WriteString(response, `{"error":"User not in chat"}`)
+		return
+	}
+	if !database.RoleOutranks(role, memberRole) || !database.RoleOutranks(role, data.Role) {
+		io.WriteString(response, `{"error":"Access denied"}`)
+		return
+	}
+
+	if memberRole == data.Role {
+		io.WriteString(response, `{"success":true}`)
+		return
+	}
+
+	err = db.SetMemberRole(data.ChatId, data.UserId, data.Role)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+
+	io.WriteString(response, `{"success":true}`)
+
+	broadcastRoleChange(db, data.ChatId, data.UserId, data.Role)
+}
+
+func broadcastRoleChange(db database.DB, chatId, userId int, role string) {
+	var message struct {
+		Event     string `json:"event"`
+		EventData struct {
+			ChatId int    `json:"chatId"`
+			UserId int    `json:"userId"`
+			Role   string `json:"role"`
+		} `json:"eventData"`
+	}
+	message.Event = "memberRoleChanged"
+	message.EventData.ChatId = chatId
+	message.EventData.UserId = userId
+	message.EventData.Role = role
+	broadcastChatEvent(db, chatId, message, nil)
+}
+
+/* Kicks the member, with ban set also keeps them from coming back */
+func removeMember(response http.ResponseWriter, request *http.Request, ban bool) {
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var data struct {
+		ChatId int `json:"chatId"`
+		UserId int `json:"userId"`
+	}
+	jsonDecoder := json.NewDecoder(request.Body)
+	err := jsonDecoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	if !checkChatAccess(response, apiToken, data.ChatId) {
+		return
+	}
+	role, allowed := checkChatPermission(response, db, userId, data.ChatId, database.PermKick)
+	if !allowed {
+		return
+	}
+
+	if data.UserId == userId {
+		io.WriteString(response, `{"error":"Use /leaveChat to leave the chat"}`)
+		return
+	}
+
+	/* Users who already left can still be banned */
+	memberRole := db.GetMemberRole(data.ChatId, data.UserId)
+	if memberRole == "" && !ban {
+		io.WriteString(response, `{"error":"User not in chat"}`)
+		return
+	}
+	if !database.RoleOutranks(role, memberRole) {
+		io.WriteString(response, `{"error":"Access denied"}`)
+		return
+	}
+
+	if ban {
+		if _, exists := db.GetUser(data.UserId); !exists {
+			io.WriteString(response, `{"error":"User not found"}`)
+			return
+		}
+
+		err = db.BanFromChat(data.ChatId, data.UserId, userId)
+		if err != nil {
+			log.Println(err)
+			io.WriteString(response, `{"error":"Server internal error"}`)
+			return
+		}
+	}
+
+	if memberRole != "" {
+		err = db.RemoveChatMember(data.UserId, data.ChatId)
+		if err != nil {
+			log.Println(err)
+			io.WriteString(response, `{"error":"Server internal error"}`)
+			return
+		}
+	}
+
+	io.WriteString(response, `{"success":true}`)
+
+	if memberRole == "" {
+		return
+	}
+
+	var message struct {
+		Event     string `json:"event"`
+		EventData struct {
+			ChatId   int  `json:"chatId"`
+			UserId   int  `json:"userId"`
+			KickedBy int  `json:"kickedBy"`
+			Banned   bool `json:"banned"`
+		} `json:"eventData"`
+	}
+	message.Event = "chatMemberLeft"
+	message.EventData.ChatId = data.ChatId
+	message.EventData.UserId = data.UserId
+	message.EventData.KickedBy = userId
+	message.EventData.Banned = ban
+	broadcastChatEvent(db, data.ChatId, message, nil)
+
+	unsubscribeFromChat(data.UserId, data.ChatId)
+}
+
+func handleKickMember(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	removeMember(response, request, false)
+}
+
+func handleBanMember(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	removeMember(response, request, true)
+}
+
+func handleUnbanMember(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var data struct {
+		ChatId int `json:"chatId"`
+		UserId int `json:"userId"`
+	}
+	jsonDecoder := json.NewDecoder(request.Body)
+	err := jsonDecoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	if !checkChatAccess(response, apiToken, data.ChatId) {
+		return
+	}
+	if _, allowed := checkChatPermission(response, db, userId, data.ChatId, database.PermKick); !allowed {
+		return
+	}
+
+	err = db.UnbanFromChat(data.ChatId, data.UserId)
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	io.WriteString(response, `{"success":true}`)
+}
+
+func handleGetBannedMembers(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	chatId, err := strconv.Atoi(request.URL.Query().Get("chatId"))
+	if err != nil {
+		io.WriteString(response, `{"error":"Invalid \"chatId\" parameter"}`)
+		return
+	}
+
+	if !checkChatAccess(response, apiToken, chatId) {
+		return
+	}
+	if _, allowed := checkChatPermission(response, db, userId, chatId, database.PermKick); !allowed {
+		return
+	}
+
+	bans, err := db.GetChatBans(chatId)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+
+	responseStruct := struct {
+		Bans []database.ChatBan `json:"bans"`
+	}{bans}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+func handleCreateInvite(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	/* Lifetime is in seconds, zero lifetime and maxUses mean no limit */
+	var data struct {
+		ChatId   int `json:"chatId"`
+		Lifetime int `json:"lifetime"`
+		MaxUses  int `json:"maxUses"`
+	}
+	jsonDecoder := json.NewDecoder(request.Body)
+	err := jsonDecoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	if data.Lifetime < 0 || data.Lifetime > 60*60*24*365 {
+		io.WriteString(response, `{"error":"Invalid lifetime"}`)
+		return
+	}
+	if data.MaxUses < 0 {
+		io.WriteString(response, `{"error":"Invalid maxUses"}`)
+		return
+	}
+
+	if !checkChatAccess(response, apiToken, data.ChatId) {
+		return
+	}
+	if _, allowed := checkChatPermission(response, db, userId, data.ChatId, database.PermInvite); !allowed {
+		return
+	}
+
+	deathTs := 0
+	if data.Lifetime > 0 {
+		deathTs = int(time.Now().Unix()) + data.Lifetime
+	}
+
+	token, invite, err := db.CreateInvite(data.ChatId, userId, deathTs, data.MaxUses)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+
+	/* The token is shown only once */
+	responseStruct := struct {
+		Token  string              `json:"token"`
+		Invite database.ChatInvite `json:"invite"`
+	}{token, invite}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+func handleGetInvites(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	chatId, err := strconv.Atoi(request.URL.Query().Get("chatId"))
+	if err != nil {
+		io.WriteString(response, `{"error":"Invalid \"chatId\" parameter"}`)
+		return
+	}
+
+	if !checkChatAccess(response, apiToken, chatId) {
+		return
+	}
+	if _, allowed := checkChatPermission(response, db, userId, chatId, database.PermInvite); !allowed {
+		return
+	}
+
+	invites, err := db.GetChatInvites(chatId)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+
+	responseStruct := struct {
+		Invites []database.ChatInvite `json:"invites"`
+	}{invites}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+func handleRevokeInvite(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var data struct {
+		ChatId   int `json:"chatId"`
+		InviteId int `json:"inviteId"`
+	}
+	jsonDecoder := json.NewDecoder(request.Body)
+	err := jsonDecoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	if !checkChatAccess(response, apiToken, data.ChatId) {
+		return
+	}
+	if _, allowed := checkChatPermission(response, db, userId, data.ChatId, database.PermInvite); !allowed {
+		return
+	}
+
+	err = db.RevokeInvite(data.ChatId, data.InviteId)
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	io.WriteString(response, `{"success":true}`)
+}
+
+func handleJoinByInvite(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	if !checkChatAccess(response, apiToken, 0) {
+		return
+	}
+
+	var data struct {
+		Token string `json:"token"`
+	}
+	jsonDecoder := json.NewDecoder(request.Body)
+	err := jsonDecoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	ipKey := "ip:" + getRemoteIp(request)
+	if retryAfter := enterChatAttempts.RetryAfter(ipKey); retryAfter > 0 {
+		writeTooManyAttempts(response, retryAfter)
+		return
+	}
+
+	chatId, err := db.JoinByInvite(userId, strings.TrimSpace(data.Token))
+	if err == database.ErrInvalidInvite {
+		enterChatAttempts.Fail(ipKey)
+	}
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	chat, err := db.GetChat(userId, chatId, true, true)
+	if err != nil {
+		io.WriteString(response, `{"error":"Internal Server Error"}`)
+		return
+	}
+
+	fillMembersPresence(chat)
+	responseStruct := struct {
+		Chat database.ChatInformation `json:"chat"`
+	}{*chat}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+func handleLeaveChat(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var dataStruct struct {
+		ChatId int `json:"chatId"`
+	}
+	jsonDecoder := json.NewDecoder(request.Body)
+	err := jsonDecoder.Decode(&dataStruct)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	userInChat := db.IsUserInChat(userId, dataStruct.ChatId)
+	if !userInChat {
+		io.WriteString(response, `{"error":"Chat not found"}`)
+		return
+	}
+
+	if !checkChatAccess(response, apiToken, dataStruct.ChatId) {
+		return
+	}
+
+	err = leaveChat(db, userId, dataStruct.ChatId)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server Internal Error"}`)
+		return
+	}
+
+	responseStruct := struct {
+		Success bool `json:"success"`
+	}{true}
+
+	encoder := json.NewEncoder(response)
+	encoder.Encode(responseStruct)
+}
+
+func handleUpdateChat(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	/* Missing fields stay unchanged */
+	var data struct {
+		ChatId      int     `json:"chatId"`
+		Name        *string `json:"name"`
+		Password    *string `json:"password"`
+		Description *string `json:"description"`
+	}
+	jsonDecoder := json.NewDecoder(request.Body)
+	err := jsonDecoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	if data.Name == nil && data.Password == nil && data.Description == nil {
+		io.WriteString(response, `{"error":"Nothing to update"}`)
+		return
+	}
+	if data.Name != nil && !validChatName.MatchString(*data.Name) {
+		io.WriteString(response, `{"error":"Invalid chat name"}`)
+		return
+	}
+	if data.Password != nil && len(*data.Password) > 32 {
+		io.WriteString(response, `{"error":"Invalid password length"}`)
+		return
+	}
+	if data.Description != nil {
+		*data.Description = strings.TrimSpace(*data.Description)
+		if utf8.RuneCountInString(*data.Description) > 256 {
+			io.WriteString(response, `{"error":"Description is too long"}`)
+			return
+		}
+	}
+
+	if !checkChatAccess(response, apiToken, data.ChatId) {
+		return
+	}
+	if _, allowed := checkChatPermission(response, db, userId, data.ChatId, database.PermEditChat); !allowed {
+		return
+	}
+
+	err = db.UpdateChat(data.ChatId, data.Name, data.Password, data.Description)
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	chat, err := db.GetChat(userId, data.ChatId, false, false)
+	if err != nil {
+		io.WriteString(response, `{"error":"Server Internal Error"}`)
+		return
+	}
+
+	responseStruct := struct {
+		Chat database.ChatInformation `json:"chat"`
+	}{*chat}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+
+	/* The password isn't revealed, only that it has changed */
+	var message struct {
+		Event     string `json:"event"`
+		EventData struct {
+			ChatId          int    `json:"chatId"`
+			Name            string `json:"name"`
+			Description     string `json:"description"`
+			PasswordChanged bool   `json:"passwordChanged"`
+			UpdatedBy       int    `json:"updatedBy"`
+		} `json:"eventData"`
+	}
+	message.Event = "chatUpdated"
+	message.EventData.ChatId = chat.Id
+	message.EventData.Name = chat.Name
+	message.EventData.Description = chat.Description
+	message.EventData.PasswordChanged = data.Password != nil
+	message.EventData.UpdatedBy = userId
+	broadcastChatEvent(db, chat.Id, message, nil)
+}
+
+func handleDeleteChat(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var data struct {
+		ChatId int `json:"chatId"`
+	}
+	jsonDecoder := json.NewDecoder(request.Body)
+	err := jsonDecoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	if !checkChatAccess(response, apiToken, data.ChatId) {
+		return
+	}
+
+	role := db.GetMemberRole(data.ChatId, userId)
+	if role == "" {
+		io.WriteString(response, `{"error":"Chat not found"}`)
+		return
+	}
+	if role != database.RoleOwner {
+		io.WriteString(response, `{"error":"Access denied"}`)
+		return
+	}
+
+	err = deleteChat(db, data.ChatId, userId)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+
+	io.WriteString(response, `{"success":true}`)
+}
+
+func handleTransferOwnership(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var data struct {
+		ChatId int `json:"chatId"`
+		UserId int `json:"userId"`
+	}
+	jsonDecoder := json.NewDecoder(request.Body)
+	err := jsonDecoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	if !checkChatAccess(response, apiToken, data.ChatId) {
+		return
+	}
+
+	role := db.GetMemberRole(data.ChatId, userId)
+	if role == "" {
+		io.WriteString(response, `{"error":"Chat not found"}`)
+		return
+	}
+	if role != database.RoleOwner {
+		io.WriteString(response, `{"error":"Access denied"}`)
+		return
+	}
+
+	if data.UserId == userId {
+		io.WriteString(response, `{"error":"You already own the chat"}`)
+		return
+	}
+	if !db.IsUserInChat(data.UserId, data.ChatId) {
+		io.WriteString(response, `{"error":"User not in chat"}`)
+		return
+	}
+
+	err = db.TransferChatOwnership(data.ChatId, data.UserId)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+
+	io.WriteString(response, `{"success":true}`)
+
+	broadcastRoleChange(db, data.ChatId, data.UserId, database.RoleOwner)
+	broadcastRoleChange(db, data.ChatId, userId, database.RoleAdmin)
+}
+
+func handleDeleteMessages(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, userId, apiToken := checkCredentials(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var dataStruct struct {
+		ChatId     int   `json:"chatId"`
+		MessageIds []int `json:"messageIds"`
+	}
+	jsonDecoder := json.NewDecoder(request.Body)
+	err := jsonDecoder.Decode(&dataStruct)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+	log.Println("data", dataStruct)
+
+	if !checkChatAccess(response, apiToken, dataStruct.ChatId) {
+		return
+	}
+
+	/* Roles are looked up once, not for every message */
+	role := db.GetMemberRole(dataStruct.ChatId, userId)
+	senderRoles := make(map[int]string)
+
+	deletedMessageIds := []int{}
+	responseSent := false
+	for _, messageId := range dataStruct.MessageIds {
+		log.Println("deleteting", messageId)
+		message, err := db.GetMessage(dataStruct.ChatId, messageId)
+		if err != nil {
+			log.Println(err)
+			responseSent = true
+			io.WriteString(response, `{"error":"Message not found"}`)
+			break
+		}
+
+		if message.SenderId != userId {
+			if role == "" {
+				responseSent = true
+				io.WriteString(response, `{"error":"Chat not found"}`)
+				break
+			}
+			/* Only messages of members with lower roles, or of those who left */
+			senderRole, known := senderRoles[message.SenderId]
+			if !known {
+				senderRole = db.GetMemberRole(dataStruct.ChatId, message.SenderId)
+				senderRoles[message.SenderId] = senderRole
+			}
+			if !database.RoleCan(role, database.PermDeleteMessages) || !database.RoleOutranks(role, senderRole) {
+				responseSent = true
+				io.WriteString(response, `{"error":"Access denied"}`)
+				break
+			}
+		}
+
+		err = db.DeleteMessage(dataStruct.ChatId, messageId)
+		if err != nil {
+			log.Println(err)
+			responseSent = true
+			io.WriteString(response, `{"error":"Server Internal Error"}`)
+			break
+		}
+		deletedMessageIds = append(deletedMessageIds, messageId)
+	}
+	log.Println("response sent -", responseSent)
+
+	if !responseSent {
+		responseStruct := struct {
+			Success bool `json:"success"`
+		}{true}
+
+		encoder := json.NewEncoder(response)
+		encoder.Encode(responseStruct)
+	}
+
+	var message struct {
+		Event     string `json:"event"`
+		EventData struct {
+			ChatId            int   `json:"chatId"`
+			DeletedMessageIds []int `json:"deletedMessageIds"`
+		} `json:"eventData"`
+	}
+	message.Event = "messagesDeleted"
+	message.EventData.ChatId = dataStruct.ChatId
+	message.EventData.DeletedMessageIds = deletedMessageIds
+	broadcastChatEvent(db, dataStruct.ChatId, message, nil)
+}
+
+/* checkAccessKey for the admin API,
+ * also fails for users without is_admin
+ */
+func checkAdminAccess(response http.ResponseWriter, request *http.Request) (database.DB, bool, int) {
+	db, authorized, userId := checkAccessKey(response, request)
+	if !authorized {
+		return db, false, 0
+	}
+
+	if !db.IsAdmin(userId) {
+		io.WriteString(response, `{"error":"Access denied"}`)
+		db.Close()
+		return db, false, 0
+	}
+
+	return db, true, userId
+}
+
+func handleAdminGetUsers(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, _ := checkAdminAccess(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	offset, count, ok := parsePagination(response, request)
+	if !ok {
+		return
+	}
+
+	searchQuery := strings.TrimSpace(request.URL.Query().Get("q"))
+	users, err := db.AdminSearchUsers(searchQuery, offset, count)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+	for i := range users {
+		users[i].Status, users[i].LastSeenTs = getPresence(users[i].Id, users[i].LastSeenTs)
+	}
+
+	responseStruct := struct {
+		Users []database.AdminUser `json:"users"`
+	}{users}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+func handleAdminGetChats(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, _ := checkAdminAccess(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	offset, count, ok := parsePagination(response, request)
+	if !ok {
+		return
+	}
+
+	searchQuery := strings.TrimSpace(request.URL.Query().Get("q"))
+	chats, err := db.AdminSearchChats(searchQuery, offset, count)
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+
+	responseStruct := struct {
+		Chats []database.ChatSummary `json:"chats"`
+	}{chats}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+func handleAdminGetStats(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, _ := checkAdminAccess(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	stats, err := db.GetServerStats()
+	if err != nil {
+		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+
+	presence.Mutex.Lock()
+	stats.OnlineUsers = len(presence.Users)
+	presence.Mutex.Unlock()
+
+	responseStruct := struct {
+		Stats database.ServerStats `json:"stats"`
+	}{stats}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+}
+
+func handleAdminBanUser(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, adminId := checkAdminAccess(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var data struct {
+		UserId int `json:"userId"`
+	}
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	if data.UserId == adminId {
+		io.WriteString(response, `{"error":"Can't ban yourself"}`)
+		return
+	}
+
+	err = db.BanUser(data.UserId)
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	log.Println("User", data.UserId, "banned by", adminId)
+	io.WriteString(response, `{"success":true}`)
+
+	closeRevokedSessionSockets(db, data.UserId)
+}
+
+func handleAdminUnbanUser(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, adminId := checkAdminAccess(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var data struct {
+		UserId int `json:"userId"`
+	}
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	err = db.UnbanUser(data.UserId)
+	if err != nil {
+		io.WriteString(response, fmt.Sprintf(`{"error":"%s"}`, err.Error()))
+		return
+	}
+
+	log.Println("User", data.UserId, "unbanned by", adminId)
+	io.WriteString(response, `{"success":true}`)
+}
+
+func handleAdminDeleteChat(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, adminId := checkAdminAccess(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var data struct {
+		ChatId int `json:"chatId"`
+	}
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
+		io.WriteString(response, `{"error":"Can't parse json"}`)
+		return
+	}
+
+	if !db.ChatExists(data.ChatId) {
+		io.WriteString(response, `{"error":"Chat not found"}`)
+		return
+	}
+
+	err = deleteChat(db, data.ChatId, adminId)
+	if err != nil {
 		log.Println(err)
+		io.WriteString(response, `{"error":"Server internal error"}`)
+		return
+	}
+
+	log.Println("Chat", data.ChatId, "deleted by", adminId)
+	io.WriteString(response, `{"success":true}`)
+}
+
+func handleAdminDeleteMessages(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	db, authorized, adminId := checkAdminAccess(response, request)
+	if !authorized {
+		return
+	}
+	defer db.Close()
+
+	var data struct {
+		ChatId     int   `json:"chatId"`
+		MessageIds []int `json:"messageIds"`
+	}
+	decoder := json.NewDecoder(request.Body)
+	err := decoder.Decode(&data)
+	if err != nil {
 		io.WriteString(response, `{"error":"Can't parse json"}`)
 		return
 	}
-	log.Println("data", dataStruct)
 
 	deletedMessageIds := []int{}
-	responseSent := false
-	for _, messageId := range dataStruct.MessageIds {
-		log.Println("deleteting", messageId)
-		message, err := db.GetMessage(dataStruct.ChatId, messageId)
+	for _, messageId := range data.MessageIds {
+		_, err = db.GetMessage(data.ChatId, messageId)
+		if err != nil {
+			continue
+		}
+
+		err = db.DeleteMessage(data.ChatId, messageId)
 		if err != nil {
 			log.Println(err)
-			responseSent = true
-			io.WriteString(response, `{"error":"Message not found"}`)
 			break
 		}
+		deletedMessageIds = append(deletedMessageIds, messageId)
+	}
+
+	responseStruct := struct {
+		DeletedMessageIds []int `json:"deletedMessageIds"`
+	}{deletedMessageIds}
+
+	jsonEncoder := json.NewEncoder(response)
+	jsonEncoder.Encode(responseStruct)
+
+	if len(deletedMessageIds) == 0 {
+		return
+	}
+
+	log.Println("Messages", deletedMessageIds, "of chat", data.ChatId, "deleted by", adminId)
+
+	var message struct {
+		Event     string `json:"event"`
+		EventData struct {
+			ChatId            int   `json:"chatId"`
+			DeletedMessageIds []int `json:"deletedMessageIds"`
+		} `json:"eventData"`
+	}
+	message.Event = "messagesDeleted"
+	message.EventData.ChatId = data.ChatId
+	message.EventData.DeletedMessageIds = deletedMessageIds
+	broadcastChatEvent(db, data.ChatId, message, nil)
+}
+
+func handleGetAttachment(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		io.WriteString(response, `{"error":"Wrong method"}`)
+		return
+	}
+
+	hash := request.URL.Query().Get("hash")
+	if hash == "" {
+		io.WriteString(response, `{"error":"No required parameter - hash"`)
+		return
+	}
+
+	filePath := fmt.Sprintf("attachments/%s", hash)
+
+	_, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		io.WriteString(response, `{"error":"Not found"}`)
+		return
+	}
+
+	binary, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		io.WriteString(response, `{"error":"Not found"}`)
+	}
+
+	bytesToDetectContentType := 512
+	if len(binary) < 512 {
+		bytesToDetectContentType = len(binary)
+	}
+	contentType := http.DetectContentType(binary[:bytesToDetectContentType])
+	response.Header().Set("Content-Type", contentType)
+
+	response.Write(binary)
+}
+
+var upgrader = ws.Upgrader{
+	ReadBufferSize:  512,
+	WriteBufferSize: 512,
+}
+
+/* UserId and SessionId are known after the first message with a valid access key.
+ * Events are sent from many goroutines and gorilla/websocket allows only one writer,
+ * so every write goes through writeToSocket and WriteMutex.
+ */
+type liveConnection struct {
+	Db         database.DB
+	UserId     int
+	SessionId  int
+	WriteMutex sync.Mutex
+}
+
+var connections = make(map[*ws.Conn]*liveConnection)
+var connectionsMutex sync.Mutex
+
+/* Sockets already closed and forgotten are skipped */
+func writeToSocket(socket *ws.Conn, message []byte) {
+	connectionsMutex.Lock()
+	connection, exists := connections[socket]
+	connectionsMutex.Unlock()
+	if !exists {
+		return
+	}
+
+	connection.WriteMutex.Lock()
+	defer connection.WriteMutex.Unlock()
+
+	socket.WriteMessage(ws.TextMessage, message)
+}
+
+func socketUserId(socket *ws.Conn) int {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+
+	if connection, exists := connections[socket]; exists {
+		return connection.UserId
+	}
+
+	return 0
+}
+
+/* Sends the message to all live sockets of the user */
+func sendToUser(userId int, message interface{}) {
+	jsonMessage, err := json.Marshal(message)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	var sockets []*ws.Conn
+	connectionsMutex.Lock()
+	for socket, connection := range connections {
+		if connection.UserId == userId {
+			sockets = append(sockets, socket)
+		}
+	}
+	connectionsMutex.Unlock()
+
+	for _, socket := range sockets {
+		writeToSocket(socket, jsonMessage)
+	}
+}
+
+/* Sends sessionRevoked to the user's sockets whose sessions no longer exist and closes them */
+func closeRevokedSessionSockets(db database.DB, userId int) {
+	/* Sessions are checked after unlocking, database round-trips
+	 * mustn't hold up other sockets connecting and disconnecting
+	 */
+	userSockets := make(map[*ws.Conn]int)
+	connectionsMutex.Lock()
+	for socket, connection := range connections {
+		if connection.UserId == userId {
+			userSockets[socket] = connection.SessionId
+		}
+	}
+	connectionsMutex.Unlock()
+
+	var revokedSockets []*ws.Conn
+	for socket, sessionId := range userSockets {
+		if !db.SessionExists(sessionId) {
+			revokedSockets = append(revokedSockets, socket)
+		}
+	}
+
+	for _, socket := range revokedSockets {
+		writeToSocket(socket, []byte(`{"event":"sessionRevoked","eventData":{}}`))
+		socket.Close()
+	}
+}
+
+type subEventBus struct {
+	Mutex   sync.Mutex
+	Sockets []*ws.Conn
+}
+
+func (seb *subEventBus) deleteSubscription(i int) {
+	seb.Sockets[i] = seb.Sockets[len(seb.Sockets)-1]
+	seb.Sockets = seb.Sockets[:len(seb.Sockets)-1]
+}
+
+/* Lookup or creation of the chat's bus and adding the socket happen under the map lock,
+ * so the bus can't be dropped in between and leave the socket on an orphaned bus
+ */
+func subscribeToChat(socket *ws.Conn, chatId int) {
+	eventBus.Mutex.Lock()
+	defer eventBus.Mutex.Unlock()
+
+	chatEventBus, exists := eventBus.Chats[chatId]
+	if !exists {
+		chatEventBus = new(subEventBus)
+		eventBus.Chats[chatId] = chatEventBus
+	}
+
+	chatEventBus.Mutex.Lock()
+	defer chatEventBus.Mutex.Unlock()
+	for _, subscriber := range chatEventBus.Sockets {
+		if subscriber == socket {
+			return
+		}
+	}
+	chatEventBus.Sockets = append(chatEventBus.Sockets, socket)
+}
+
+/* Stops delivering the chat's events to the user's sockets */
+func unsubscribeFromChat(userId, chatId int) {
+	eventBus.Mutex.Lock()
+	defer eventBus.Mutex.Unlock()
+
+	chatEventBus, exists := eventBus.Chats[chatId]
+	if !exists {
+		return
+	}
+
+	chatEventBus.Mutex.Lock()
+	for i := len(chatEventBus.Sockets) - 1; i >= 0; i-- {
+		if socketUserId(chatEventBus.Sockets[i]) == userId {
+			chatEventBus.deleteSubscription(i)
+		}
+	}
+	if len(chatEventBus.Sockets) == 0 {
+		delete(eventBus.Chats, chatId)
+	}
+	chatEventBus.Mutex.Unlock()
+}
+
+/* Mutex guards the Chats map itself, each subEventBus guards its own sockets.
+ * When both are needed, Mutex is taken first.
+ */
+var eventBus struct {
+	Mutex sync.RWMutex
+	Chats map[int]*subEventBus
+}
+
+const (
+	presenceOnline  = "online"
+	presenceAway    = "away"
+	presenceOffline = "offline"
+)
+
+/* Users without activity for this long are away */
+const awayAfter = time.Minute * 5
+
+/* Presence of users with open /liveUpdates sockets, everyone else is offline */
+type userPresence struct {
+	Sockets      int
+	LastActivity time.Time
+	Status       string
+}
+
+var presence = struct {
+	Mutex sync.Mutex
+	Users map[int]*userPresence
+}{Users: make(map[int]*userPresence)}
+
+func presenceConnected(userId int) {
+	presence.Mutex.Lock()
+	userState, exists := presence.Users[userId]
+	if !exists {
+		userState = &userPresence{Status: presenceOffline}
+		presence.Users[userId] = userState
+	}
+	userState.Sockets++
+	userState.LastActivity = time.Now()
+	changed := userState.Status != presenceOnline
+	userState.Status = presenceOnline
+	presence.Mutex.Unlock()
+
+	if changed {
+		go broadcastPresence(userId, presenceOnline, int(time.Now().Unix()))
+	}
+}
+
+func presenceDisconnected(userId int) {
+	presence.Mutex.Lock()
+	userState, exists := presence.Users[userId]
+	if !exists {
+		presence.Mutex.Unlock()
+		return
+	}
+	userState.Sockets--
+	lastSeenTs := int(userState.LastActivity.Unix())
+	if userState.Sockets > 0 {
+		presence.Mutex.Unlock()
+		return
+	}
+	delete(presence.Users, userId)
+	presence.Mutex.Unlock()
+
+	db, err := openSqlConnection()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = db.SetLastSeen(userId, lastSeenTs)
+	if err != nil {
+		log.Println(err)
+	}
+	db.Close()
+
+	go broadcastPresence(userId, presenceOffline, lastSeenTs)
+}
+
+func presenceActivity(userId int) {
+	presence.Mutex.Lock()
+	userState, exists := presence.Users[userId]
+	if !exists {
+		presence.Mutex.Unlock()
+		return
+	}
+	userState.LastActivity = time.Now()
+	changed := userState.Status != presenceOnline
+	userState.Status = presenceOnline
+	presence.Mutex.Unlock()
+
+	if changed {
+		go broadcastPresence(userId, presenceOnline, int(time.Now().Unix()))
+	}
+}
+
+/* Marks idle users as away */
+func watchPresence(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		type presenceChange struct {
+			UserId     int
+			LastSeenTs int
+		}
+		var becameAway []presenceChange
 
-		if message.SenderId != userId {
-			var chat *database.ChatInformation
-			chat, err = db.GetChat(userId, dataStruct.ChatId, false, false)
-			if err != nil {
-				log.Println(err)
-				responseSent = true
-				io.WriteString(response, `{"error":"Chat not found"}`)
-				break
-			}
-			if chat.OwnerId != userId {
-				log.Println(err)
-				responseSent = true
-				io.WriteString(response, `{"error":"Access denied"}`)
-				break
+		presence.Mutex.Lock()
+		for userId, userState := range presence.Users {
+			if userState.Status == presenceOnline && time.Since(userState.LastActivity) > awayAfter {
+				userState.Status = presenceAway
+				becameAway = append(becameAway, presenceChange{userId, int(userState.LastActivity.Unix())})
 			}
 		}
+		presence.Mutex.Unlock()
 
-		err = db.DeleteMessage(dataStruct.ChatId, messageId)
-		if err != nil {
-			log.Println(err)
-			responseSent = true
-			io.WriteString(response, `{"error":"Server Internal Error"}`)
-			break
+		for _, change := range becameAway {
+			broadcastPresence(change.UserId, presenceAway, change.LastSeenTs)
 		}
-		deletedMessageIds = append(deletedMessageIds, messageId)
 	}
-	log.Println("response sent -", responseSent)
+}
 
-	if !responseSent {
-		responseStruct := struct {
-			Success bool `json:"success"`
-		}{true}
+/* Returns status and last seen time,
+ * storedLastSeenTs is used for users who are offline
+ */
+func getPresence(userId, storedLastSeenTs int) (string, int) {
+	presence.Mutex.Lock()
+	defer presence.Mutex.Unlock()
 
-		encoder := json.NewEncoder(response)
-		encoder.Encode(responseStruct)
+	userState, exists := presence.Users[userId]
+	if !exists {
+		return presenceOffline, storedLastSeenTs
 	}
 
-	if eventBus, exists := eventBus.Chats[dataStruct.ChatId]; exists {
-		eventBus.Mutex.Lock()
-
-		var message struct {
-			Event     string `json:"event"`
-			EventData struct {
-				ChatId            int   `json:"chatId"`
-				DeletedMessageIds []int `json:"deletedMessageIds"`
-			} `json:"eventData"`
-		}
-		message.Event = "messagesDeleted"
-		message.EventData.ChatId = dataStruct.ChatId
-		message.EventData.DeletedMessageIds = deletedMessageIds
-		jsonMessage, err := json.Marshal(message)
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		wg := sync.WaitGroup{}
-		for _, subscriber := range eventBus.Sockets {
-			wg.Add(1)
-			go func(subscriber *ws.Conn) {
-				subscriber.WriteMessage(ws.TextMessage, jsonMessage)
-				wg.Done()
-			}(subscriber)
-		}
-		wg.Wait()
+	return userState.Status, int(userState.LastActivity.Unix())
+}
 
-		eventBus.Mutex.Unlock()
+func fillMembersPresence(chat *database.ChatInformation) {
+	for i := range chat.Members {
+		chat.Members[i].Status, chat.Members[i].LastSeenTs = getPresence(chat.Members[i].Id, chat.Members[i].LastSeenTs)
 	}
 }
 
-func handleGetAttachment(response http.ResponseWriter, request *http.Request) {
-	if request.Method != "GET" {
-		io.WriteString(response, `{"error":"Wrong method"}`)
+func broadcastPresence(userId int, status string, lastSeenTs int) {
+	db, err := openSqlConnection()
+	if err != nil {
+		log.Println(err)
 		return
 	}
+	defer db.Close()
 
-	hash := request.URL.Query().Get("hash")
-	if hash == "" {
-		io.WriteString(response, `{"error":"No required parameter - hash"`)
+	chats, err := db.GetUserChats(userId)
+	if err != nil {
+		log.Println(err)
 		return
 	}
 
-	filePath := fmt.Sprintf("attachments/%s", hash)
+	chatIds := make([]int, len(chats))
+	for i, chat := range chats {
+		chatIds[i] = chat.Id
+	}
 
-	_, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		io.WriteString(response, `{"error":"Not found"}`)
-		return
+	var message struct {
+		Event     string `json:"event"`
+		EventData struct {
+			UserId     int    `json:"userId"`
+			Status     string `json:"status"`
+			LastSeenTs int    `json:"lastSeenTs"`
+		} `json:"eventData"`
 	}
+	message.Event = "presenceChanged"
+	message.EventData.UserId = userId
+	message.EventData.Status = status
+	message.EventData.LastSeenTs = lastSeenTs
+	broadcastToChats(chatIds, message)
+}
 
-	binary, err := ioutil.ReadFile(filePath)
+/* Message and chat events also go to bots of the chat,
+ * through the caller's connection.
+ * Sockets and bots of excludedUserIds are skipped.
+ */
+func broadcastChatEvent(db database.DB, chatId int, message interface{}, excludedUserIds map[int]bool) {
+	jsonMessage, err := json.Marshal(message)
 	if err != nil {
-		io.WriteString(response, `{"error":"Not found"}`)
+		log.Println(err)
+		return
 	}
 
-	contentType := http.DetectContentType(binary[:512])
-	response.Header().Set("Content-Type", contentType)
-
-	response.Write(binary)
-}
-
-var upgrader = ws.Upgrader{
-	ReadBufferSize:  512,
-	WriteBufferSize: 512,
+	queueBotUpdates(db, chatId, jsonMessage, excludedUserIds)
+	writeToChatsSubscribers([]int{chatId}, jsonMessage, excludedUserIds)
 }
 
-var connections = make(map[*ws.Conn]database.DB)
-
-type subEventBus struct {
-	Mutex   sync.Mutex
-	Sockets []*ws.Conn
-}
+/* Sent to live subscribers only, bots don't follow presence or profiles */
+func broadcastToChats(chatIds []int, message interface{}) {
+	jsonMessage, err := json.Marshal(message)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
-func (seb *subEventBus) deleteSubscription(i int) {
-	seb.Sockets[i] = seb.Sockets[len(seb.Sockets)-1]
-	seb.Sockets = seb.Sockets[:len(seb.Sockets)-1]
+	writeToChatsSubscribers(chatIds, jsonMessage, nil)
 }
 
-var eventBus struct {
-	Chats map[int]*subEventBus
+/* Every subscriber gets the message once,
+ * even if it is subscribed to several of the chats.
+ * Sockets of excludedUserIds are skipped.
+ */
+func writeToChatsSubscribers(chatIds []int, jsonMessage []byte, excludedUserIds map[int]bool) {
+	var chatEventBuses []*subEventBus
+	eventBus.Mutex.RLock()
+	for _, chatId := range chatIds {
+		if chatEventBus, exists := eventBus.Chats[chatId]; exists {
+			chatEventBuses = append(chatEventBuses, chatEventBus)
+		}
+	}
+	eventBus.Mutex.RUnlock()
+
+	wg := sync.WaitGroup{}
+	notified := make(map[*ws.Conn]bool)
+	for _, chatEventBus := range chatEventBuses {
+		chatEventBus.Mutex.Lock()
+		for _, subscriber := range chatEventBus.Sockets {
+			if notified[subscriber] {
+				continue
+			}
+			notified[subscriber] = true
+			if len(excludedUserIds) > 0 && excludedUserIds[socketUserId(subscriber)] {
+				continue
+			}
+			wg.Add(1)
+			go func(subscriber *ws.Conn) {
+				writeToSocket(subscriber, jsonMessage)
+				wg.Done()
+			}(subscriber)
+		}
+		wg.Wait()
+		chatEventBus.Mutex.Unlock()
+	}
 }
 
 func handleLiveUpdates(response http.ResponseWriter, request *http.Request) {
+	/* Cookie from the handshake, used when messages carry no access key.
+	 * The upgrader refuses cross-origin handshakes, so other sites can't use it.
+	 */
+	cookieAccessKey := ""
+	if cookie, err := request.Cookie(accessKeyCookie); err == nil {
+		cookieAccessKey = cookie.Value
+	}
+
 	socket, err := upgrader.Upgrade(response, request, nil)
 	if err != nil {
 		log.Println("Upgrade error", err)
@@ -837,34 +4063,25 @@ func handleLiveUpdates(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	connections[socket] = db
-
-	socket.SetCloseHandler(func(code int, text string) error {
-		db, exists := connections[socket]
-		if exists {
-			db.Close()
-		}
-		delete(connections, socket)
-		for chatId, chatEventBus := range eventBus.Chats {
-			chatEventBus.Mutex.Lock()
-			for i, subscriber := range chatEventBus.Sockets {
-				if subscriber == socket {
-					chatEventBus.deleteSubscription(i)
-					if len(chatEventBus.Sockets) == 0 {
-						delete(eventBus.Chats, chatId)
-					}
-					break
-				}
-			}
-			chatEventBus.Mutex.Unlock()
+	connection := &liveConnection{Db: db}
+	var cookieUserId, cookieSessionId int
+	if cookieAccessKey != "" {
+		if keyExists, userId := db.ValidateAccessKey(cookieAccessKey); keyExists {
+			cookieUserId = userId
+			cookieSessionId, _ = db.GetSessionId(cookieAccessKey)
 		}
-		return nil
-	})
+	}
+
+	connectionsMutex.Lock()
+	connections[socket] = connection
+	connectionsMutex.Unlock()
+
+	/* Runs however the socket ends: close frame, dropped connection or denied access */
+	defer closeLiveConnection(socket)
 
 	for {
 		messageType, message, err := socket.ReadMessage()
 		if err != nil {
-			socket.CloseHandler()
 			break
 		}
 
@@ -878,27 +4095,126 @@ func handleLiveUpdates(response http.ResponseWriter, request *http.Request) {
 			}
 			json.Unmarshal(message, &parsedMessage)
 
-			keyExists, _ := db.ValidateAccessKey(parsedMessage.AccessKey)
+			var (
+				keyExists bool
+				userId    int
+				sessionId int
+			)
+			if parsedMessage.AccessKey == "" && cookieSessionId != 0 {
+				/* The cookie expires with the access key, the socket lives as long as the session */
+				keyExists = db.SessionExists(cookieSessionId)
+				userId, sessionId = cookieUserId, cookieSessionId
+			} else {
+				keyExists, userId = db.ValidateAccessKey(parsedMessage.AccessKey)
+				sessionId, _ = db.GetSessionId(parsedMessage.AccessKey)
+			}
 			if !keyExists {
-				socket.WriteMessage(ws.TextMessage, []byte(`{"error":"Access denied"}`))
-				socket.CloseHandler()
+				writeToSocket(socket, []byte(`{"error":"Access denied"}`))
 				break
 			}
 
+			connectionsMutex.Lock()
+			previousUserId := connection.UserId
+			connection.UserId = userId
+			connection.SessionId = sessionId
+			connectionsMutex.Unlock()
+
+			/* Any message including "activity" pings counts as activity */
+			if previousUserId != userId {
+				if previousUserId != 0 {
+					presenceDisconnected(previousUserId)
+				}
+				presenceConnected(userId)
+			} else {
+				presenceActivity(userId)
+			}
+
 			if parsedMessage.Event == "subscribe" {
 				for _, chatId := range parsedMessage.EventData.Chats {
-					chatEventBus, exists := eventBus.Chats[chatId]
-					if !exists {
-						chatEventBus = new(subEventBus)
-						eventBus.Chats[chatId] = chatEventBus
+					if !db.IsUserInChat(userId, chatId) {
+						continue
 					}
-					chatEventBus.Mutex.Lock()
-					chatEventBus.Sockets = append(chatEventBus.Sockets, socket)
-					chatEventBus.Mutex.Unlock()
+					subscribeToChat(socket, chatId)
+				}
+			}
+		}
+	}
+}
+
+/* Forgets the socket: closes its database connection, reports the user
+ * disconnected and removes the socket from chat subscriptions
+ */
+func closeLiveConnection(socket *ws.Conn) {
+	connectionsMutex.Lock()
+	connection, exists := connections[socket]
+	if exists {
+		connection.Db.Close()
+	}
+	delete(connections, socket)
+	connectionsMutex.Unlock()
+
+	if exists && connection.UserId != 0 {
+		presenceDisconnected(connection.UserId)
+	}
+
+	eventBus.Mutex.Lock()
+	defer eventBus.Mutex.Unlock()
+	for chatId, chatEventBus := range eventBus.Chats {
+		chatEventBus.Mutex.Lock()
+		for i, subscriber := range chatEventBus.Sockets {
+			if subscriber == socket {
+				chatEventBus.deleteSubscription(i)
+				if len(chatEventBus.Sockets) == 0 {
+					delete(eventBus.Chats, chatId)
 				}
+				break
 			}
 		}
+		chatEventBus.Mutex.Unlock()
+	}
+}
+
+/* Networks of reverse proxies, set by the trustedProxies environment variable
+ * as comma-separated CIDRs. Only their X-Forwarded-For headers are believed.
+ */
+var trustedProxies []*net.IPNet
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/* Behind trusted proxies the client is the last X-Forwarded-For address
+ * not belonging to them, anything before it may be forged by the client
+ */
+func getRemoteIp(request *http.Request) string {
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		ip = request.RemoteAddr
+	}
+
+	if !isTrustedProxy(net.ParseIP(ip)) {
+		return ip
+	}
+
+	forwardedFor := strings.Split(strings.Join(request.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		forwardedIp := net.ParseIP(strings.TrimSpace(forwardedFor[i]))
+		if forwardedIp == nil {
+			break
+		}
+		ip = forwardedIp.String()
+		if !isTrustedProxy(forwardedIp) {
+			break
+		}
 	}
+
+	return ip
 }
 
 func openSqlConnection() (db database.DB, err error) {
@@ -915,19 +4231,185 @@ func openSqlConnection() (db database.DB, err error) {
 }
 
 func logEventBus() {
-	log.Println(eventBus)
+	eventBus.Mutex.RLock()
+	log.Println(eventBus.Chats)
 	for key, value := range eventBus.Chats {
 		log.Println(key, value)
 	}
+	eventBus.Mutex.RUnlock()
 	time.Sleep(5 * time.Second)
 	logEventBus()
 }
 
+/* Expired sessions are already rejected by ValidateAccessKey and RefreshAccessKey,
+ * this only keeps access_keys from growing forever
+ */
+func purgeExpiredAccessKeys(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		db, err := openSqlConnection()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		deletedCount, err := db.DeleteExpiredAccessKeys()
+		if err != nil {
+			log.Println("Can't purge expired access keys", err)
+		} else if deletedCount > 0 {
+			log.Println("Purged expired access keys:", deletedCount)
+		}
+
+		db.Close()
+	}
+}
+
+/* Admin operation, run as `chatter -resetPassword username`
+ * and hand the printed code over to the user
+ */
+func printPasswordResetCode(username string) {
+	db, err := openSqlConnection()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer db.Close()
+
+	err = db.InitDatabase()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	code, deathTs, err := db.CreatePasswordResetCode(username)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	fmt.Printf("Password reset code for %s: %s\n", username, code)
+	fmt.Printf("Valid until %s\n", time.Unix(int64(deathTs), 0).Format(time.RFC1123))
+}
+
+/* Admin operation, run as `chatter -issueBotToken starterBot` */
+func printBotToken(botUsername string) {
+	db, err := openSqlConnection()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer db.Close()
+
+	err = db.InitDatabase()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	token, err := db.IssueBotToken(botUsername)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	fmt.Printf("Token for %s: %s\n", botUsername, token)
+}
+
+/* Admin operation, run as `chatter -grantAdmin username`,
+ * `-revokeAdmin username` takes the role back
+ */
+func setAdmin(username string, isAdmin bool) {
+	db, err := openSqlConnection()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer db.Close()
+
+	err = db.InitDatabase()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = db.SetAdmin(username, isAdmin)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if isAdmin {
+		fmt.Printf("%s is an admin now\n", username)
+	} else {
+		fmt.Printf("%s is not an admin anymore\n", username)
+	}
+}
+
 func main() {
+	resetPasswordFor := flag.String("resetPassword", "", "print a one-time password reset code for the username and exit")
+	issueBotTokenFor := flag.String("issueBotToken", "", "print a new token for the bot, e.g. starterBot, and exit")
+	grantAdminTo := flag.String("grantAdmin", "", "give the username access to the admin API and exit")
+	revokeAdminFrom := flag.String("revokeAdmin", "", "take access to the admin API from the username and exit")
+	flag.Parse()
+
+	if *resetPasswordFor != "" {
+		printPasswordResetCode(*resetPasswordFor)
+		return
+	}
+
+	if *issueBotTokenFor != "" {
+		printBotToken(*issueBotTokenFor)
+		return
+	}
+
+	if *grantAdminTo != "" {
+		setAdmin(*grantAdminTo, true)
+		return
+	}
+
+	if *revokeAdminFrom != "" {
+		setAdmin(*revokeAdminFrom, false)
+		return
+	}
+
 	eventBus.Chats = make(map[int]*subEventBus)
 
 	// go logEventBus()
 
+	if bcryptCost := os.Getenv("bcryptCost"); bcryptCost != "" {
+		cost, err := strconv.Atoi(bcryptCost)
+		if err != nil {
+			log.Fatalln("Invalid bcryptCost", err)
+		}
+		database.BcryptCost = cost
+	}
+
+	if accessKeyLifetime := os.Getenv("accessKeyLifetime"); accessKeyLifetime != "" {
+		lifetime, err := time.ParseDuration(accessKeyLifetime)
+		if err != nil {
+			log.Fatalln("Invalid accessKeyLifetime", err)
+		}
+		database.AccessKeyLifetime = lifetime
+	}
+
+	if sessionLifetime := os.Getenv("sessionLifetime"); sessionLifetime != "" {
+		lifetime, err := time.ParseDuration(sessionLifetime)
+		if err != nil {
+			log.Fatalln("Invalid sessionLifetime", err)
+		}
+		database.SessionLifetime = lifetime
+	}
+
+	if proxies := os.Getenv("trustedProxies"); proxies != "" {
+		for _, cidr := range strings.Split(proxies, ",") {
+			_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				log.Fatalln("Invalid trustedProxies", err)
+			}
+			trustedProxies = append(trustedProxies, network)
+		}
+	}
+
+	if insecure := os.Getenv("insecureCookies"); insecure != "" {
+		value, err := strconv.ParseBool(insecure)
+		if err != nil {
+			log.Fatalln("Invalid insecureCookies", err)
+		}
+		insecureCookies = value
+	}
+
 	db, err := openSqlConnection()
 	if err != nil {
 		log.Fatalln(err)
@@ -940,6 +4422,13 @@ func main() {
 
 	db.Close()
 
+	go purgeExpiredAccessKeys(time.Hour)
+	go authAttempts.forgetStale(time.Minute * 10)
+	go enterChatAttempts.forgetStale(time.Minute * 10)
+	go searchRequests.forgetStale(time.Minute * 10)
+	go watchPresence(time.Minute)
+	go retryWebhooks(time.Minute)
+
 	/* Static */
 	staticAssets := http.FileServer(http.Dir("content/assets"))
 	staticJs := http.FileServer(http.Dir("content/js"))
@@ -957,17 +4446,65 @@ func main() {
 	/* Api */
 	http.HandleFunc("/registerUser", handleRegisterUser)
 	http.HandleFunc("/auth", handleAuth)
+	http.HandleFunc("/authTotp", handleAuthTotp)
+	http.HandleFunc("/resetPassword", handleResetPassword)
+	http.HandleFunc("/refresh", handleRefresh)
+	http.HandleFunc("/logout", handleLogout)
+	http.HandleFunc("/getSessions", handleGetSessions)
+	http.HandleFunc("/revokeSession", handleRevokeSession)
+	http.HandleFunc("/changePassword", handleChangePassword)
+	http.HandleFunc("/deleteAccount", handleDeleteAccount)
+	http.HandleFunc("/setupTotp", handleSetupTotp)
+	http.HandleFunc("/confirmTotp", handleConfirmTotp)
+	http.HandleFunc("/disableTotp", handleDisableTotp)
+	http.HandleFunc("/createApiToken", handleCreateApiToken)
+	http.HandleFunc("/getApiTokens", handleGetApiTokens)
+	http.HandleFunc("/revokeApiToken", handleRevokeApiToken)
 	http.HandleFunc("/getMe", handleGetMe)
 	http.HandleFunc("/getChats", handleGetChats)
 	http.HandleFunc("/getChat", handleGetChat)
 	http.HandleFunc("/getUser", handleGetUser)
+	http.HandleFunc("/searchUsers", handleSearchUsers)
+	http.HandleFunc("/updateProfile", handleUpdateProfile)
+	http.HandleFunc("/blockUser", handleBlockUser)
+	http.HandleFunc("/unblockUser", handleUnblockUser)
+	http.HandleFunc("/getBlockedUsers", handleGetBlockedUsers)
 	http.HandleFunc("/sendMessage", handleSendMessage)
 	http.HandleFunc("/getMessages", handleGetMessages)
 	http.HandleFunc("/enterChat", handleEnterChat)
 	http.HandleFunc("/createChat", handleCreateChat)
 	http.HandleFunc("/leaveChat", handleLeaveChat)
+	http.HandleFunc("/startDirectChat", handleStartDirectChat)
+	http.HandleFunc("/createInvite", handleCreateInvite)
+	http.HandleFunc("/getInvites", handleGetInvites)
+	http.HandleFunc("/revokeInvite", handleRevokeInvite)
+	http.HandleFunc("/joinByInvite", handleJoinByInvite)
+	http.HandleFunc("/setMemberRole", handleSetMemberRole)
+	http.HandleFunc("/kickMember", handleKickMember)
+	http.HandleFunc("/banMember", handleBanMember)
+	http.HandleFunc("/unbanMember", handleUnbanMember)
+	http.HandleFunc("/getBannedMembers", handleGetBannedMembers)
+	http.HandleFunc("/transferOwnership", handleTransferOwnership)
+	http.HandleFunc("/updateChat", handleUpdateChat)
+	http.HandleFunc("/deleteChat", handleDeleteChat)
 	http.HandleFunc("/deleteMessages", handleDeleteMessages)
 
+	/* Bot API */
+	http.HandleFunc("/createBot", handleCreateBot)
+	http.HandleFunc("/getMyBots", handleGetMyBots)
+	http.HandleFunc("/regenerateBotToken", handleRegenerateBotToken)
+	http.HandleFunc("/getUpdates", handleGetUpdates)
+	http.HandleFunc("/setWebhook", handleSetWebhook)
+
+	/* Admin API */
+	http.HandleFunc("/adminGetUsers", handleAdminGetUsers)
+	http.HandleFunc("/adminGetChats", handleAdminGetChats)
+	http.HandleFunc("/adminGetStats", handleAdminGetStats)
+	http.HandleFunc("/adminBanUser", handleAdminBanUser)
+	http.HandleFunc("/adminUnbanUser", handleAdminUnbanUser)
+	http.HandleFunc("/adminDeleteChat", handleAdminDeleteChat)
+	http.HandleFunc("/adminDeleteMessages", handleAdminDeleteMessages)
+
 	/* Attachments */
 	http.HandleFunc("/attachment", handleGetAttachment)
 